@@ -0,0 +1,71 @@
+package gocommonweb
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+type eventNATS struct {
+	conn          *nats.Conn
+	queueGroup    string
+	subscriptions map[string]*nats.Subscription
+	mu            sync.Mutex
+}
+
+// NewEventNATS create new event bus using nats, event name is used as nats subject.
+// if queueGroup is not empty every subscription joins that queue group so an event
+// is handled by only one subscriber in the group instead of broadcast to all of them
+func NewEventNATS(conn *nats.Conn, queueGroup string) Event {
+	return &eventNATS{
+		conn:          conn,
+		queueGroup:    queueGroup,
+		subscriptions: make(map[string]*nats.Subscription),
+		mu:            sync.Mutex{},
+	}
+}
+
+func (e *eventNATS) Publish(eventName string, payload string) error {
+	return e.conn.Publish(eventName, []byte(payload))
+}
+
+func (e *eventNATS) Subscribe(eventName string, handler EventHandler) error {
+	callback := func(msg *nats.Msg) {
+		handler.Handle(msg.Subject, string(msg.Data))
+	}
+
+	var subscription *nats.Subscription
+	var err error
+	if e.queueGroup != "" {
+		subscription, err = e.conn.QueueSubscribe(eventName, e.queueGroup, callback)
+	} else {
+		subscription, err = e.conn.Subscribe(eventName, callback)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	previous := e.subscriptions[eventName]
+	e.subscriptions[eventName] = subscription
+	e.mu.Unlock()
+
+	if previous != nil {
+		_ = previous.Unsubscribe()
+	}
+	return nil
+}
+
+func (e *eventNATS) Unsubscribe(eventName string) {
+	e.mu.Lock()
+	subscription, ok := e.subscriptions[eventName]
+	delete(e.subscriptions, eventName)
+	e.mu.Unlock()
+
+	if ok {
+		if err := subscription.Unsubscribe(); err != nil {
+			logrus.Debugf("[Event] err unsubscribe nats subject %s: %s", eventName, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package gocommonweb
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+type chanEventHandler chan string
+
+func (c chanEventHandler) Handle(eventName string, payload string) {
+	c <- eventName + ":" + payload
+}
+
+type countEventHandler struct {
+	count int32
+}
+
+func (c *countEventHandler) Handle(eventName string, payload string) {
+	atomic.AddInt32(&c.count, 1)
+}
+
+func runNATSServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	require.True(t, s.ReadyForConnections(time.Second*5))
+	return s
+}
+
+func connectNATS(t *testing.T, s *server.Server) *nats.Conn {
+	conn, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	return conn
+}
+
+func TestEventNATSPublishSubscribe(t *testing.T) {
+	s := runNATSServer(t)
+	defer s.Shutdown()
+	conn := connectNATS(t, s)
+	defer conn.Close()
+
+	event := NewEventNATS(conn, "")
+	received := make(chanEventHandler, 1)
+	require.NoError(t, event.Subscribe("server_0", received))
+	require.NoError(t, conn.Flush())
+
+	require.NoError(t, event.Publish("server_0", "hello"))
+	select {
+	case msg := <-received:
+		require.Equal(t, "server_0:hello", msg)
+	case <-time.After(time.Second * 5):
+		t.Fatal("event not received")
+	}
+
+	event.Unsubscribe("server_0")
+	require.NoError(t, conn.Flush())
+	require.NoError(t, event.Publish("server_0", "hello again"))
+	select {
+	case msg := <-received:
+		t.Fatalf("received event after unsubscribe: %s", msg)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestEventNATSQueueGroup(t *testing.T) {
+	s := runNATSServer(t)
+	defer s.Shutdown()
+
+	handler := &countEventHandler{}
+	for i := 0; i < 3; i++ {
+		conn := connectNATS(t, s)
+		defer conn.Close()
+		require.NoError(t, NewEventNATS(conn, "workers").Subscribe("task", handler))
+		require.NoError(t, conn.Flush())
+	}
+
+	conn := connectNATS(t, s)
+	defer conn.Close()
+	publisher := NewEventNATS(conn, "")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, publisher.Publish("task", "payload"))
+	}
+	require.NoError(t, conn.Flush())
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&handler.count) == 10
+	}, time.Second*5, time.Millisecond*10)
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, int32(10), atomic.LoadInt32(&handler.count))
+}
@@ -0,0 +1,220 @@
+package integration_testing
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abdularis/gocommonweb"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestQueueDBSQLiteSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skip test for database queue on sqlite")
+	}
+
+	suite.Run(t, &queueDBTestSuite{
+		openDB: func(t *testing.T) *gorm.DB {
+			dsn := "file:" + filepath.Join(t.TempDir(), "queue.db") + "?_journal_mode=WAL&_busy_timeout=5000"
+			db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+			require.NoError(t, err)
+			return db
+		},
+	})
+}
+
+type queueDBTestSuite struct {
+	suite.Suite
+	openDB func(t *testing.T) *gorm.DB
+	db     *gorm.DB
+}
+
+func (s *queueDBTestSuite) SetupTest() {
+	s.db = s.openDB(s.T())
+}
+
+func (s *queueDBTestSuite) TearDownTest() {
+	sqlDB, err := s.db.DB()
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), sqlDB.Close())
+}
+
+func (s *queueDBTestSuite) newQueue(workers int) gocommonweb.TransactionalQueue {
+	queue, err := gocommonweb.NewQueueDBWithOptions(s.db, gocommonweb.QueueDBOptions{
+		Queues:       []gocommonweb.WorkerQueue{{Name: gocommonweb.DefaultQueueName, Workers: workers}},
+		PollInterval: time.Millisecond * 50,
+	})
+	require.NoError(s.T(), err)
+	return queue
+}
+
+// waitFor poll condition until it holds or timeout passes
+func (s *queueDBTestSuite) waitFor(timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			s.T().Fatal("condition not met before timeout")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// TestEveryJobHandledOnce several queues on the same database act as
+// separate processes competing for the same jobs
+func (s *queueDBTestSuite) TestEveryJobHandledOnce() {
+	const jobCount = 200
+	var mutex sync.Mutex
+	handled := make(map[string]int)
+	handler := gocommonweb.JobContextHandlerFunc(func(ctx context.Context, job *gocommonweb.Job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled[job.Payload]++
+		return nil
+	})
+
+	var queues []gocommonweb.Queue
+	for i := 0; i < 3; i++ {
+		queue := s.newQueue(4)
+		queue.AddJobContextHandler("send_email", handler)
+		queues = append(queues, queue)
+	}
+	for i := 0; i < jobCount; i++ {
+		require.NoError(s.T(), queues[i%len(queues)].AddJob("send_email", fmt.Sprint(i)))
+	}
+	for _, queue := range queues {
+		queue.Start()
+		defer queue.Close()
+	}
+
+	s.waitFor(time.Second*30, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(handled) == jobCount
+	})
+	for _, queue := range queues {
+		queue.Close()
+	}
+
+	for payload, count := range handled {
+		require.Equal(s.T(), 1, count, "job %s handled more than once", payload)
+	}
+	stats, err := queues[0].Stats()
+	require.NoError(s.T(), err)
+	require.Len(s.T(), stats, 1)
+	require.Equal(s.T(), int64(0), stats[0].Waiting)
+	require.Equal(s.T(), int64(0), stats[0].Processing)
+}
+
+func (s *queueDBTestSuite) TestRetryAndFail() {
+	queue := s.newQueue(2)
+	queue.SetJobOptions("charge", gocommonweb.JobOptions{Retry: gocommonweb.RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     gocommonweb.ConstantBackoff(0),
+	}})
+	queue.AddJobContextHandler("charge", gocommonweb.JobContextHandlerFunc(func(ctx context.Context, job *gocommonweb.Job) error {
+		return fmt.Errorf("card declined on attempt %d", job.Attempt)
+	}))
+
+	id, err := queue.AddJobAt("charge", "order-1", time.Now())
+	require.NoError(s.T(), err)
+	queue.Start()
+	defer queue.Close()
+
+	s.waitFor(time.Second*10, func() bool {
+		status, err := queue.GetJobStatus(id)
+		return err == nil && status.Status == gocommonweb.JobFailed
+	})
+	failedJobs, err := queue.FailedJobs("charge", 0, 10)
+	require.NoError(s.T(), err)
+	require.Len(s.T(), failedJobs, 1)
+	require.Len(s.T(), failedJobs[0].History, 2)
+	require.Equal(s.T(), "card declined on attempt 2", failedJobs[0].Error)
+}
+
+func (s *queueDBTestSuite) TestUniqueAndTransactionalJobs() {
+	queue := s.newQueue(1)
+
+	enqueued, err := queue.AddUniqueJob("sync", "account-1", gocommonweb.UniqueOptions{})
+	require.NoError(s.T(), err)
+	require.True(s.T(), enqueued)
+	enqueued, err = queue.AddUniqueJob("sync", "account-1", gocommonweb.UniqueOptions{})
+	require.NoError(s.T(), err)
+	require.False(s.T(), enqueued)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(s.T(), queue.AddJobTx(tx, "sync", "rolled back"))
+		return fmt.Errorf("rollback")
+	})
+	require.Error(s.T(), err)
+
+	handled := make(chan string, 10)
+	queue.AddJobContextHandler("sync", gocommonweb.JobContextHandlerFunc(func(ctx context.Context, job *gocommonweb.Job) error {
+		handled <- job.Payload
+		return nil
+	}))
+	queue.Start()
+	defer queue.Close()
+
+	select {
+	case payload := <-handled:
+		require.Equal(s.T(), "account-1", payload)
+	case <-time.After(time.Second * 5):
+		s.T().Fatal("job not handled")
+	}
+	select {
+	case payload := <-handled:
+		s.T().Fatalf("unexpected job %s", payload)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func (s *queueDBTestSuite) TestJobLimitAcrossQueues() {
+	var mutex sync.Mutex
+	running, maxRunning, done := 0, 0, 0
+	handler := gocommonweb.JobContextHandlerFunc(func(ctx context.Context, job *gocommonweb.Job) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+
+		mutex.Lock()
+		running--
+		done++
+		mutex.Unlock()
+		return nil
+	})
+
+	var queues []gocommonweb.Queue
+	for i := 0; i < 2; i++ {
+		queue := s.newQueue(3)
+		queue.SetJobOptions("call_api", gocommonweb.JobOptions{Limit: gocommonweb.JobLimit{Concurrency: 2}})
+		queue.AddJobContextHandler("call_api", handler)
+		queues = append(queues, queue)
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(s.T(), queues[0].AddJob("call_api", fmt.Sprint(i)))
+	}
+	for _, queue := range queues {
+		queue.Start()
+		defer queue.Close()
+	}
+
+	s.waitFor(time.Second*60, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return done == 20
+	})
+	require.LessOrEqual(s.T(), maxRunning, 2)
+}
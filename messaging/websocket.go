@@ -20,7 +20,7 @@ func WebSocketUpgrade(messenger Messenger, clientID string, w http.ResponseWrite
 	conn, err := wsupgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		logrus.Debug("Failed to set websocket upgrade: %+v", err)
+		logrus.Debugf("Failed to set websocket upgrade: %+v", err)
 		return
 	}
 
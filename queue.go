@@ -1,15 +1,345 @@
 package gocommonweb
 
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
 // JobHandler callback for handling actual job
 type JobHandler interface {
 	Handle(jobName string, payload string) error
 }
 
+// Job descriptor of a job given to JobContextHandler
+type Job struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Payload string `json:"payload"`
+
+	// Attempt current attempt number starting from 1
+	Attempt int `json:"attempt"`
+
+	// MaxAttempts number of attempts before job is given up, zero means unlimited
+	MaxAttempts int `json:"max_attempts"`
+
+	EnqueuedAt  time.Time `json:"enqueued_at"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+
+	// progressReporter stores progress of the attempt, set by queue running the job
+	progressReporter func(pct int, message string) error
+	result           string
+}
+
+// JobContextHandler callback for handling job with its descriptor,
+// ctx is cancelled when the queue is closing
+type JobContextHandler interface {
+	HandleJob(ctx context.Context, job *Job) error
+}
+
+// JobContextHandlerFunc use ordinary function as JobContextHandler
+type JobContextHandlerFunc func(ctx context.Context, job *Job) error
+
+func (f JobContextHandlerFunc) HandleJob(ctx context.Context, job *Job) error {
+	return f(ctx, job)
+}
+
+type jobHandlerAdapter struct {
+	handler JobHandler
+}
+
+func (a jobHandlerAdapter) HandleJob(_ context.Context, job *Job) error {
+	return a.handler.Handle(job.Name, job.Payload)
+}
+
+// AdaptJobHandler wrap JobHandler so it can be used as JobContextHandler
+func AdaptJobHandler(handler JobHandler) JobContextHandler {
+	return jobHandlerAdapter{handler: handler}
+}
+
+// DefaultQueueName queue of jobs that don't specify one in JobOptions
+const DefaultQueueName = "default"
+
+// WorkerQueue named queue and number of workers processing its jobs
+type WorkerQueue struct {
+	Name    string
+	Workers int
+
+	// VisibilityTimeout of jobs in the queue for database queue, zero means
+	// QueueDBOptions.VisibilityTimeout
+	VisibilityTimeout time.Duration
+}
+
+// PriorityOrder how workers pick between jobs of different priority in a queue
+type PriorityOrder int
+
+const (
+	// PriorityStrict always pick job with the highest priority first
+	PriorityStrict PriorityOrder = iota
+
+	// PriorityWeighted pick priority randomly weighted by its value,
+	// lower priority jobs still make progress when queue is busy
+	PriorityWeighted
+)
+
+// JobOptions configuration applied to every job with the same name
+type JobOptions struct {
+	Retry RetryPolicy
+
+	// Queue name the job is put into, empty means DefaultQueueName
+	Queue string
+
+	// Priority within the queue, higher runs first. zero means 1
+	Priority int
+
+	// Timeout of a single attempt, zero means no timeout. when it expires handler
+	// context is cancelled and the attempt fails with ErrJobTimeout. handler must
+	// return once its context is done, worker waits for it up to TimeoutGrace
+	Timeout time.Duration
+
+	// TimeoutGrace how long worker waits for handler to return after Timeout
+	// cancelled its context before failing the attempt, default 5 seconds.
+	// handler still running after that keeps running on its own
+	TimeoutGrace time.Duration
+
+	// Limit concurrency and start rate of the job, no limit by default
+	Limit JobLimit
+
+	// VisibilityTimeout of the job in database queue, zero means
+	// visibility timeout of its queue
+	VisibilityTimeout time.Duration
+}
+
+// ErrJobNotPending job does not exist or is no longer waiting to run
+var ErrJobNotPending = errors.New("job not found or no longer pending")
+
+// ErrJobTimeout attempt error of job that runs longer than JobOptions.Timeout
+var ErrJobTimeout = errors.New("job timeout exceeded")
+
+const defaultJobTimeoutGrace = time.Second * 5
+
+func (o JobOptions) queueName() string {
+	if o.Queue == "" {
+		return DefaultQueueName
+	}
+	return o.Queue
+}
+
+func (o JobOptions) timeoutGrace() time.Duration {
+	if o.TimeoutGrace <= 0 {
+		return defaultJobTimeoutGrace
+	}
+	return o.TimeoutGrace
+}
+
+func (o JobOptions) priority() int {
+	if o.Priority <= 0 {
+		return 1
+	}
+	return o.Priority
+}
+
+// JobAttempt result of a single failed job execution, Attempt keeps
+// counting up when a failed job is retried while Job.Attempt starts over
+type JobAttempt struct {
+	Attempt    int       `json:"attempt"`
+	Error      string    `json:"error"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// FailedJob job that ran out of attempts or failed with non retryable error
+type FailedJob struct {
+	Job
+	Error    string       `json:"error"`
+	FailedAt time.Time    `json:"failed_at"`
+	History  []JobAttempt `json:"history"`
+}
+
+// FailedJobManager inspect and act on jobs that failed permanently,
+// empty jobName in the methods below means all job names
+type FailedJobManager interface {
+	// FailedJobs page of failed jobs oldest first, limit <= 0 means no limit
+	FailedJobs(jobName string, offset int, limit int) ([]FailedJob, error)
+
+	// RetryFailedJob put failed job back to the queue with fresh attempts
+	RetryFailedJob(id string) error
+	RetryFailedJobs(jobName string) (int, error)
+
+	DeleteFailedJob(id string) error
+	DeleteFailedJobs(jobName string) (int, error)
+
+	// ExportFailedJobs write failed jobs to w as json lines
+	ExportFailedJobs(w io.Writer, jobName string) error
+}
+
+// UniqueOptions how duplicated job is detected by AddUniqueJob
+type UniqueOptions struct {
+	// Key explicit uniqueness key, if empty job name and payload is used
+	Key string
+
+	// Window keep the job unique for this duration after it completes,
+	// zero means the same job can be enqueued again as soon as it completes
+	Window time.Duration
+}
+
 // Queue async job execution
 type Queue interface {
+	FailedJobManager
+
 	AddJob(jobName string, payload string) error
 	AddDelayedJob(jobName string, payload string, delaySecs uint) error
+
+	// AddJobAt enqueue job to run at runAt and return its id, job
+	// with runAt in the past is run as soon as possible
+	AddJobAt(jobName string, payload string, runAt time.Time) (string, error)
+
+	// CancelJob remove job that is still waiting or scheduled,
+	// ErrJobNotPending is returned when it already started or finished
+	CancelJob(id string) error
+
+	// Reschedule change run time of job that is still waiting or scheduled
+	Reschedule(id string, runAt time.Time) error
+
+	// AddUniqueJob enqueue job unless a matching job is still waiting or processing,
+	// or completed within the uniqueness window. it returns false if job is not enqueued
+	AddUniqueJob(jobName string, payload string, options UniqueOptions) (bool, error)
 	AddJobHandler(jobName string, handler JobHandler)
+	AddJobContextHandler(jobName string, handler JobContextHandler)
+
+	// SetJobOptions configure how jobs with given name are processed,
+	// it should be called before Start
+	SetJobOptions(jobName string, options JobOptions)
+
+	// Use add middleware wrapping every job handler, panic of handler
+	// is always recovered and recorded as failed attempt
+	Use(middleware ...JobMiddleware)
+
+	// Stats job counts per queue and job name together with
+	// attempt metrics of workers in this process
+	Stats() ([]JobStats, error)
+
+	// GetJobStatus state, progress, result and last error of job with id,
+	// ErrJobNotFound is returned when the job is unknown or already removed
+	GetJobStatus(id string) (*JobStatus, error)
+
+	// PublishJobStatus publish JobStatus as json to eventName of event on every job state change
+	PublishJobStatus(event Event, eventName string)
 	Start()
+
+	// Shutdown stop taking new jobs and wait for running jobs until ctx is done,
+	// jobs still running after that are cancelled and put back to the queue
+	Shutdown(ctx context.Context) error
+
+	// Close shutdown the queue waiting for running jobs without deadline
 	Close()
 }
+
+// lostJobNotifier implemented by queues that fail a job without running its
+// handler, callback of the job name is called once the job failed permanently
+type lostJobNotifier interface {
+	onJobLost(jobName string, callback func(job *Job, err error))
+}
+
+// handleJobWithTimeout run handler within the job timeout, once its context is done
+// handler is given the grace period to return, handler that ignores its context is
+// left running after that so the worker can move on. handler runs with a copy of job
+// whose result is only taken when it returned in time, progress it reports after
+// the attempt is over is refused
+func handleJobWithTimeout(ctx context.Context, handler JobContextHandler, job *Job, options JobOptions) error {
+	timeout := options.Timeout
+	if timeout <= 0 {
+		return handler.HandleJob(ctx, job)
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var attemptMutex sync.Mutex
+	attemptOver := false
+	handlerJob := *job
+	handlerJob.progressReporter = func(pct int, message string) error {
+		attemptMutex.Lock()
+		defer attemptMutex.Unlock()
+		if attemptOver {
+			return jobCtx.Err()
+		}
+		if job.progressReporter == nil {
+			return nil
+		}
+		return job.progressReporter(pct, message)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- handler.HandleJob(jobCtx, &handlerJob)
+	}()
+
+	endAttempt := func() {
+		attemptMutex.Lock()
+		attemptOver = true
+		attemptMutex.Unlock()
+	}
+
+	var err error
+	select {
+	case err = <-result:
+		job.result = handlerJob.result
+		endAttempt()
+	case <-jobCtx.Done():
+		err = jobCtx.Err()
+		endAttempt()
+		grace := time.NewTimer(options.timeoutGrace())
+		select {
+		case <-result:
+		case <-grace.C:
+			logrus.Warnf("[queue] job %s - %s handler still running %s after its context is done, it should return once the context is done",
+				job.Name, job.ID, options.timeoutGrace())
+		}
+		grace.Stop()
+	}
+
+	if err != nil && ctx.Err() == nil && jobCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w after %s", ErrJobTimeout, timeout)
+	}
+	return err
+}
+
+const exportPageSize = 100
+
+// exportFailedJobs write all failed jobs returned page by page from list as json lines
+func exportFailedJobs(w io.Writer, list func(offset int, limit int) ([]FailedJob, error)) error {
+	encoder := json.NewEncoder(w)
+	for offset := 0; ; offset += exportPageSize {
+		failedJobs, err := list(offset, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, failedJob := range failedJobs {
+			if err := encoder.Encode(failedJob); err != nil {
+				return err
+			}
+		}
+		if len(failedJobs) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+// uniqueJobKey build uniqueness key scoped by job name, payload
+// is hashed to keep the key size bounded
+func uniqueJobKey(jobName string, payload string, key string) string {
+	if key != "" {
+		return jobName + ":key:" + key
+	}
+	sum := sha256.Sum256([]byte(payload))
+	return jobName + ":payload:" + hex.EncodeToString(sum[:])
+}
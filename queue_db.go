@@ -1,9 +1,13 @@
 package gocommonweb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,47 +19,208 @@ const (
 	statusWaiting    = "waiting"
 	statusProcessing = "processing"
 	statusComplete   = "complete"
+	statusFailed     = "failed"
 )
 
 type job struct {
-	gorm.Model
-	JobName     string
+	// fields of gorm.Model, UpdatedAt is the finish time of completed and
+	// failed jobs and is indexed with Status for the retention janitor
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time      `gorm:"index:idx_jobs_retention,priority:2"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	JobName     string `gorm:"index:idx_jobs_stats,priority:3"`
 	Payload     string
-	Status      string    `gorm:"index"`
-	RunAt       time.Time `gorm:"index"`
+	Queue       string    `gorm:"index;index:idx_jobs_stats,priority:2"`
+	Priority    int       `gorm:"index"`
+	Status      string    `gorm:"index;index:idx_jobs_stats,priority:1;index:idx_jobs_retention,priority:1"`
+	RunAt       time.Time `gorm:"index;index:idx_jobs_stats,priority:4"`
 	LastVisited time.Time `gorm:"index"`
+	Attempts    int
+	LastError   string
+
+	// UniqueKey set for jobs added by AddUniqueJob, it is cleared when the job
+	// completes without uniqueness window or a duplicate takes it over, failed
+	// job keeps it so it blocks duplicates again once retried. UniqueFor is the
+	// uniqueness window after completion and UniqueUntil the time the window ends
+	UniqueKey   *string `gorm:"uniqueIndex;size:255"`
+	UniqueFor   time.Duration
+	UniqueUntil *time.Time
+
+	// LimitKey and StartedAt are set when the job is claimed, they are
+	// used to count running and recently started jobs of a JobLimit
+	LimitKey  string     `gorm:"index;size:255"`
+	StartedAt *time.Time `gorm:"index"`
+
+	// LeaseUntil time processing job is considered lost unless its worker
+	// sends heartbeat, it is extended by VisibilityTimeout on every heartbeat
+	LeaseUntil *time.Time `gorm:"index"`
+
+	// Progress and ProgressMessage reported by the running attempt,
+	// Result payload set by handler of completed job
+	Progress        int
+	ProgressMessage string
+	Result          string
+}
+
+// jobLimitLock row locked while checking a JobLimit so workers of
+// several processes can't start jobs over the limit at the same time
+type jobLimitLock struct {
+	LimitKey string `gorm:"primaryKey;size:255"`
+}
+
+// jobAttempt history of failed job executions
+type jobAttempt struct {
+	ID         uint `gorm:"primarykey"`
+	JobID      uint `gorm:"index"`
+	Attempt    int
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
 }
 
 type queueDB struct {
-	db              *gorm.DB
-	startMutex      sync.Mutex
-	running         bool
-	workerCount     int
-	handlers        map[string]JobHandler
-	handlerMutex    sync.Mutex
-	stopRequeueChan chan bool
-	stopWorkersChan []chan bool
+	jobMiddlewares
+	jobMetrics
+	jobStatusEvents
+	db             *gorm.DB
+	startMutex     sync.Mutex
+	running        bool
+	options        QueueDBOptions
+	handlers       map[string]JobContextHandler
+	jobOptions     map[string]JobOptions
+	lostCallbacks  map[string]func(job *Job, err error)
+	handlerMutex   sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	closed         bool
+	stopChan       chan struct{}
+	loopsWaitGroup sync.WaitGroup
+
+	// wake per queue signal that jobs may be ready for its idle workers
+	wake map[string]chan struct{}
+
+	// inFlight jobs currently handled by this process, once abandoned
+	// is set they have been put back to the queue by Shutdown
+	inFlight      map[uint]bool
+	abandoned     bool
+	inFlightMutex sync.Mutex
+}
+
+// QueueDBOptions configuration of database backed queue
+type QueueDBOptions struct {
+	// Queues named queues and their worker count, jobs without
+	// explicit queue are processed by DefaultQueueName workers
+	Queues []WorkerQueue
+
+	PriorityOrder PriorityOrder
+
+	// Retention of completed and failed jobs, jobs are kept forever by default
+	Retention QueueDBRetention
+
+	// PollInterval how often idle workers look for due jobs, they are woken
+	// right away by jobs added in this process or NOTIFY on postgres, default 1 second
+	PollInterval time.Duration
+
+	// BatchSize max jobs claimed at once for idle workers of a queue, default 10
+	BatchSize int
+
+	// DisableSkipLocked claim jobs with plain FOR UPDATE on databases without
+	// SKIP LOCKED support e.g. MySQL before 8.0 or MariaDB before 10.6
+	DisableSkipLocked bool
+
+	// VisibilityTimeout how long processing job may go without heartbeat before
+	// its worker is considered lost and the job is requeued as failed attempt,
+	// default 15 minutes. WorkerQueue and JobOptions override it per queue and job name
+	VisibilityTimeout time.Duration
+
+	// HeartbeatInterval how often running jobs extend their lease and stale
+	// jobs are looked for, default 10 seconds
+	HeartbeatInterval time.Duration
+}
+
+// TransactionalQueue database queue whose jobs can be enqueued within caller's
+// transaction, the job commits or rolls back together with caller's writes
+// and workers only see it after commit. tx must be on the queue database
+type TransactionalQueue interface {
+	Queue
+	AddJobTx(tx *gorm.DB, jobName string, payload string) error
+	AddJobAtTx(tx *gorm.DB, jobName string, payload string, runAt time.Time) (string, error)
+
+	// WakeWorkers wake idle workers of this process to look for due jobs, call it
+	// after committing jobs added with AddJobTx. on postgres workers are woken by
+	// NOTIFY once tx commits, elsewhere they pick the jobs up within PollInterval
+	WakeWorkers()
 }
 
 // NewQueueDB create job queue backend by database
-func NewQueueDB(db *gorm.DB, workerCount int) (Queue, error) {
-	if workerCount <= 0 {
-		panic(fmt.Errorf("queue job worker count must not be <= 0"))
+// with workerCount workers for the default queue
+func NewQueueDB(db *gorm.DB, workerCount int) (TransactionalQueue, error) {
+	return NewQueueDBWithOptions(db, QueueDBOptions{
+		Queues: []WorkerQueue{{Name: DefaultQueueName, Workers: workerCount}},
+	})
+}
+
+// NewQueueDBWithOptions create job queue backend by database
+func NewQueueDBWithOptions(db *gorm.DB, options QueueDBOptions) (TransactionalQueue, error) {
+	if len(options.Queues) == 0 {
+		panic(fmt.Errorf("queue must have at least one worker queue"))
+	}
+	wake := make(map[string]chan struct{})
+	for _, queue := range options.Queues {
+		if queue.Workers <= 0 {
+			panic(fmt.Errorf("queue %s job worker count must not be <= 0", queue.Name))
+		}
+		wake[queue.Name] = make(chan struct{}, 1)
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultDBPollInterval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultDBBatchSize
+	}
+	if options.VisibilityTimeout <= 0 {
+		options.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = defaultHeartbeatInterval
 	}
 
-	err := db.AutoMigrate(&job{})
+	// jobs created before named queues existed belong to default queue,
+	// they are moved once when the queue column is added
+	backfillQueue := db.Migrator().HasTable(&job{}) && !db.Migrator().HasColumn(&job{}, "Queue")
+	err := db.AutoMigrate(&job{}, &jobAttempt{}, &jobLimitLock{})
 	if err != nil {
 		return nil, err
 	}
+	if backfillQueue {
+		err = db.Model(&job{}).Where("queue = ? OR queue IS NULL", "").Update("queue", DefaultQueueName).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.Retention.Archive {
+		if err := db.AutoMigrate(&archivedJob{}); err != nil {
+			return nil, err
+		}
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &queueDB{
-		db:              db,
-		handlers:        make(map[string]JobHandler),
-		startMutex:      sync.Mutex{},
-		handlerMutex:    sync.Mutex{},
-		workerCount:     workerCount,
-		running:         false,
-		stopRequeueChan: make(chan bool),
+		db:            db,
+		handlers:      make(map[string]JobContextHandler),
+		jobOptions:    make(map[string]JobOptions),
+		lostCallbacks: make(map[string]func(job *Job, err error)),
+		ctx:           ctx,
+		cancel:        cancel,
+		startMutex:    sync.Mutex{},
+		handlerMutex:  sync.Mutex{},
+		options:       options,
+		running:       false,
+		stopChan:      make(chan struct{}),
+		wake:          wake,
+		inFlight:      make(map[uint]bool),
 	}, nil
 }
 
@@ -64,148 +229,793 @@ func (q *queueDB) AddJob(jobName string, payload string) error {
 }
 
 func (q *queueDB) AddDelayedJob(jobName string, payload string, delaySecs uint) error {
-	runAt := time.Now()
-	if delaySecs > 0 {
-		runAt = time.Now().Add(time.Second * time.Duration(delaySecs))
+	_, err := q.AddJobAt(jobName, payload, time.Now().Add(time.Second*time.Duration(delaySecs)))
+	return err
+}
+
+func (q *queueDB) AddJobTx(tx *gorm.DB, jobName string, payload string) error {
+	_, err := q.AddJobAtTx(tx, jobName, payload, time.Now())
+	return err
+}
+
+func (q *queueDB) AddJobAtTx(tx *gorm.DB, jobName string, payload string, runAt time.Time) (string, error) {
+	id, queueName, err := q.createJob(tx, jobName, payload, runAt)
+	if err != nil {
+		return "", err
+	}
+	if err := q.notifyJobAdded(tx, queueName, runAt); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (q *queueDB) AddJobAt(jobName string, payload string, runAt time.Time) (string, error) {
+	id, queueName, err := q.createJob(q.db, jobName, payload, runAt)
+	if err != nil {
+		return "", err
+	}
+	return id, q.jobAdded(q.db, queueName, runAt)
+}
+
+func (q *queueDB) createJob(tx *gorm.DB, jobName string, payload string, runAt time.Time) (string, string, error) {
+	j := q.newJob(jobName, payload, runAt)
+	// new session drops conditions caller may have chained on tx
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	if err := tx.Create(&j).Error; err != nil {
+		return "", "", err
+	}
+	return formatJobID(j.ID), j.Queue, nil
+}
+
+func (q *queueDB) WakeWorkers() {
+	q.wakeWorkers("")
+}
+
+// storedIn whether jobs are stored in the database of db, so they
+// can be added within its transactions
+func (q *queueDB) storedIn(db *gorm.DB) bool {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return false
+	}
+	queueSQLDB, err := q.db.DB()
+	return err == nil && queueSQLDB == sqlDB
+}
+
+func (q *queueDB) CancelJob(id string) error {
+	jobID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		// unscoped so unique key of cancelled job is gone with the row
+		res := tx.Unscoped().Where("id = ? AND status = ?", jobID, statusWaiting).Delete(&job{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrJobNotPending
+		}
+		return tx.Where("job_id = ?", jobID).Delete(&jobAttempt{}).Error
+	})
+}
+
+func (q *queueDB) Reschedule(id string, runAt time.Time) error {
+	jobID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+
+	res := q.db.Model(&job{}).
+		Where("id = ? AND status = ?", jobID, statusWaiting).
+		Update("run_at", runAt)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrJobNotPending
+	}
+	return q.jobAdded(q.db, "", runAt)
+}
+
+func (q *queueDB) AddUniqueJob(jobName string, payload string, options UniqueOptions) (bool, error) {
+	key := uniqueJobKey(jobName, payload, options.Key)
+	enqueued := false
+	queueName := ""
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		var existing job
+		err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("unique_key = ?", key).
+			First(&existing).Error
+		if err == nil {
+			if existing.isBlockingDuplicate() {
+				return nil
+			}
+			err = tx.Model(&job{}).Where("id = ?", existing.ID).Update("unique_key", nil).Error
+			if err != nil {
+				return err
+			}
+		} else if err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		// row of a concurrent enqueue of the same job conflicts on the unique index
+		j := q.newJob(jobName, payload, time.Now())
+		j.UniqueKey = &key
+		j.UniqueFor = options.Window
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&j)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		enqueued = true
+		queueName = j.Queue
+		return q.notifyJobAdded(tx, j.Queue, j.RunAt)
+	})
+	if err == nil && enqueued {
+		q.wakeWorkers(queueName)
 	}
-	j := job{
+	return enqueued, err
+}
+
+// newJob create job row placed in the queue and priority configured for jobName
+func (q *queueDB) newJob(jobName string, payload string, runAt time.Time) job {
+	q.handlerMutex.Lock()
+	options := q.jobOptions[jobName]
+	q.handlerMutex.Unlock()
+
+	return job{
 		JobName:     jobName,
 		Payload:     payload,
+		Queue:       options.queueName(),
+		Priority:    options.priority(),
 		Status:      statusWaiting,
 		RunAt:       runAt,
 		LastVisited: time.Now(),
 	}
-	return q.db.Create(&j).Error
+}
+
+func (j *job) isBlockingDuplicate() bool {
+	if j.Status == statusWaiting || j.Status == statusProcessing {
+		return true
+	}
+	return j.Status == statusComplete && j.UniqueUntil != nil && j.UniqueUntil.After(time.Now())
 }
 
 func (q *queueDB) AddJobHandler(jobName string, handler JobHandler) {
+	q.AddJobContextHandler(jobName, AdaptJobHandler(handler))
+}
+
+func (q *queueDB) AddJobContextHandler(jobName string, handler JobContextHandler) {
 	q.handlerMutex.Lock()
 	defer q.handlerMutex.Unlock()
 	q.handlers[jobName] = handler
 }
 
+func (q *queueDB) SetJobOptions(jobName string, options JobOptions) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	q.jobOptions[jobName] = options
+}
+
+func (q *queueDB) onJobLost(jobName string, callback func(job *Job, err error)) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	q.lostCallbacks[jobName] = callback
+}
+
+func (q *queueDB) getHandler(jobName string) (JobContextHandler, JobOptions, bool) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	handler, ok := q.handlers[jobName]
+	return handler, q.jobOptions[jobName], ok
+}
+
+// handledJobNames job names of the queue this process has handler for
+func (q *queueDB) handledJobNames(queueName string) []string {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	names := make([]string, 0, len(q.handlers))
+	for name := range q.handlers {
+		if q.jobOptions[name].queueName() == queueName {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func (q *queueDB) Start() {
 	q.startMutex.Lock()
 	defer q.startMutex.Unlock()
-	if !q.running {
+	if !q.running && !q.closed {
 		q.running = true
-		for i := 0; i < q.workerCount; i++ {
-			stopChan := make(chan bool)
-			q.stopWorkersChan = append(q.stopWorkersChan, stopChan)
-			go q.startWorkerLoop(stopChan)
+		for _, queue := range q.options.Queues {
+			q.loopsWaitGroup.Add(1)
+			go q.startFetchLoop(queue)
 		}
+		if q.isPostgres() {
+			q.loopsWaitGroup.Add(1)
+			go q.startListenLoop()
+		}
+		q.loopsWaitGroup.Add(1)
 		go q.startJobRequeueLoop()
+		if q.options.Retention.enabled() {
+			q.loopsWaitGroup.Add(1)
+			go q.startJanitorLoop()
+		}
 		logrus.Info("[qdb] worker and scheduler running...")
 	}
 }
 
 func (q *queueDB) Close() {
-	q.stopRequeueChan <- true
-	for _, stopChan := range q.stopWorkersChan {
-		stopChan <- true
+	_ = q.Shutdown(context.Background())
+}
+
+// Shutdown stop claiming new jobs and wait for running jobs until ctx is done,
+// after that their handler context is cancelled and the jobs are put back as waiting
+func (q *queueDB) Shutdown(ctx context.Context) error {
+	q.startMutex.Lock()
+	if q.closed {
+		q.startMutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	wasRunning := q.running
+	q.running = false
+	close(q.stopChan)
+	q.startMutex.Unlock()
+
+	if !wasRunning {
+		q.cancel()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.loopsWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		logrus.Info("[qdb] queue shutdown gracefully")
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.cancel()
+	q.inFlightMutex.Lock()
+	q.abandoned = true
+	jobIDs := make([]uint, 0, len(q.inFlight))
+	for jobID := range q.inFlight {
+		jobIDs = append(jobIDs, jobID)
 	}
+	q.inFlightMutex.Unlock()
+
+	if len(jobIDs) > 0 {
+		if err := q.putBackJobs(jobIDs); err != nil {
+			return err
+		}
+		logrus.Infof("[qdb] %d unfinished jobs put back to queue", len(jobIDs))
+	}
+	return ctx.Err()
 }
 
-func (q *queueDB) startJobRequeueLoop() {
-	timer := time.NewTimer(time.Second)
+// putBackJobs make claimed jobs waiting again without using up their attempt
+func (q *queueDB) putBackJobs(jobIDs []uint) error {
+	return q.db.Model(&job{}).
+		Where("id IN ? AND status = ?", jobIDs, statusProcessing).
+		Updates(map[string]interface{}{
+			"status":       statusWaiting,
+			"attempts":     gorm.Expr("attempts - 1"),
+			"last_visited": time.Now(),
+			"lease_until":  nil,
+		}).Error
+}
+
+// startFetchLoop claim jobs of the queue in batches for its idle workers, it runs
+// when woken by a new job or an idle worker and every PollInterval otherwise
+func (q *queueDB) startFetchLoop(queue WorkerQueue) {
+	defer q.loopsWaitGroup.Done()
+	jobs := make(chan *job)
+	var idle int32
+	for i := 0; i < queue.Workers; i++ {
+		q.loopsWaitGroup.Add(1)
+		go q.startWorkerLoop(queue.Name, jobs, &idle)
+	}
+
+	timer := time.NewTimer(0)
 	for {
 		select {
 		case <-timer.C:
-			err := q.db.Transaction(func(tx *gorm.DB) error {
-				var res job
-				err := tx.
-					Clauses(clause.Locking{Strength: "UPDATE"}).
-					Where("status = ? AND last_visited <= ?", statusProcessing, time.Now().Add(-maxLastVisitedDuration)).
-					First(&res).Error
-				if err != nil {
-					return err
-				}
+		case <-q.wake[queue.Name]:
+			timer.Stop()
+		case <-q.stopChan:
+			timer.Stop()
+			logrus.Info("[qdb] fetch loop stopped")
+			return
+		}
+
+		next := q.options.PollInterval
+		if idleWorkers := int(atomic.LoadInt32(&idle)); idleWorkers > 0 {
+			limit := idleWorkers
+			if limit > q.options.BatchSize {
+				limit = q.options.BatchSize
+			}
+			claimed, err := q.claimJobs(queue.Name, limit)
+			if err != nil && err != gorm.ErrRecordNotFound && err != errJobDeferred {
+				logrus.Errorf("[qdb] claim jobs of queue %s: %s", queue.Name, err)
+			}
+			if !q.dispatchJobs(jobs, &idle, claimed) {
+				return
+			}
+			if err == errJobDeferred {
+				next = q.nextDueDelay(queue.Name, next)
+			} else if len(claimed) == limit {
+				next = 0
+			}
+		}
+		timer = time.NewTimer(next)
+	}
+}
 
-				err = tx.Model(&job{}).
-					Where("id = ?", res.ID).
-					Updates(job{Status: statusWaiting, LastVisited: time.Now()}).Error
+// nextDueDelay how long until the earliest waiting job of the queue is due,
+// between minDeferredDelay and max
+func (q *queueDB) nextDueDelay(queueName string, max time.Duration) time.Duration {
+	var next job
+	err := q.db.
+		Where("status = ? AND queue = ? AND job_name IN ?", statusWaiting, queueName, q.handledJobNames(queueName)).
+		Order("run_at").
+		Limit(1).
+		Find(&next).Error
+	if err != nil || next.ID == 0 {
+		return max
+	}
 
-				if err == nil {
-					logrus.Debugf("[qdb] requeue job %s - %d\n", res.JobName, res.ID)
-				}
-				return err
-			})
+	delay := time.Until(next.RunAt)
+	if delay < minDeferredDelay {
+		return minDeferredDelay
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
 
-			if err == gorm.ErrRecordNotFound {
-				timer = time.NewTimer(time.Minute * 10)
-			} else {
-				timer = time.NewTimer(time.Second * 10)
+// dispatchJobs hand claimed jobs to idle workers, jobs not handed out
+// when the queue stops are put back. it returns false once stopped
+func (q *queueDB) dispatchJobs(jobs chan<- *job, idle *int32, claimed []*job) bool {
+	for i, j := range claimed {
+		select {
+		case jobs <- j:
+			atomic.AddInt32(idle, -1)
+		case <-q.stopChan:
+			jobIDs := make([]uint, 0, len(claimed)-i)
+			for _, left := range claimed[i:] {
+				jobIDs = append(jobIDs, left.ID)
 			}
-			break
-		case <-q.stopRequeueChan:
-			logrus.Info("[qdb] requeue loop stopped")
-			return
+			if err := q.putBackJobs(jobIDs); err != nil {
+				logrus.Errorf("[qdb] put back claimed jobs: %s", err)
+			}
+			return false
 		}
 	}
+	return true
 }
 
-func (q *queueDB) startWorkerLoop(stop chan bool) {
-	timer := time.NewTimer(time.Second)
+func (q *queueDB) startWorkerLoop(queueName string, jobs <-chan *job, idle *int32) {
+	defer q.loopsWaitGroup.Done()
 	for {
+		atomic.AddInt32(idle, 1)
+		q.wakeWorkers(queueName)
 		select {
-		case <-timer.C:
-			j, err := q.findJobToProcess()
-			if err == nil {
-				if handler, ok := q.handlers[j.JobName]; ok {
-					visitor := jobVisitor{stopChannel: make(chan bool)}
-					go visitor.startVisiting(func() {
-						_ = q.updateLastVisited(j.ID)
-					})
-					err := handler.Handle(j.JobName, j.Payload)
-					visitor.stop()
-
-					if err == nil {
-						_ = q.updateJobStatus(j.ID, statusComplete)
-					} else {
-						_ = q.updateJobStatus(j.ID, statusWaiting)
+		case j := <-jobs:
+			q.processJob(j)
+		case <-q.stopChan:
+			logrus.Info("[qdb] worker loop stopped")
+			return
+		}
+	}
+}
+
+func (q *queueDB) processJob(j *job) {
+	handler, options, ok := q.getHandler(j.JobName)
+	if !ok {
+		_ = q.updateJobStatus(j.ID, statusWaiting)
+		return
+	}
+
+	q.inFlightMutex.Lock()
+	q.inFlight[j.ID] = true
+	q.inFlightMutex.Unlock()
+
+	visibilityTimeout := q.visibilityTimeout(options)
+	visitor := jobVisitor{stopChannel: make(chan bool), interval: q.heartbeatInterval(visibilityTimeout)}
+	go visitor.startVisiting(func() {
+		_ = q.extendLease(j, visibilityTimeout)
+	})
+	descriptor := j.descriptor()
+	descriptor.MaxAttempts = options.Retry.maxAttemptsDescriptor()
+	startStatus := j.jobStatus()
+	descriptor.progressReporter = func(pct int, message string) error {
+		return q.updateProgress(j.ID, startStatus, pct, message)
+	}
+	q.publishStatus(startStatus)
+	startedAt := time.Now()
+	err := handleJobWithTimeout(q.ctx, q.wrap(handler), descriptor, options)
+	visitor.stop()
+
+	q.inFlightMutex.Lock()
+	delete(q.inFlight, j.ID)
+	abandoned := q.abandoned
+	q.inFlightMutex.Unlock()
+	if abandoned {
+		// job already put back to the queue by Shutdown
+		return
+	}
+
+	q.recordAttempt(j.Queue, j.JobName, j.RunAt, startedAt, err)
+	if err == nil {
+		j.Result = descriptor.result
+		err = q.completeJob(j)
+	} else {
+		err = q.failJob(j, options.Retry, err, startedAt)
+	}
+	if err == nil {
+		q.publishCurrentStatus(formatJobID(j.ID), q.GetJobStatus)
+	}
+}
+
+// findJobToProcess claim a single job of the queue
+func (q *queueDB) findJobToProcess(queueName string) (*job, error) {
+	claimed, err := q.claimJobs(queueName, 1)
+	if err != nil {
+		return nil, err
+	}
+	return claimed[0], nil
+}
+
+// claimJobs claim up to limit due jobs of the queue by priority and run time.
+// gorm.ErrRecordNotFound is returned when there is no due job and errJobDeferred
+// when every due job found was deferred by its JobLimit
+func (q *queueDB) claimJobs(queueName string, limit int) ([]*job, error) {
+	// only claim jobs this worker able to handle, another
+	// process may have handlers for the rest of them
+	jobNames := q.handledJobNames(queueName)
+	if len(jobNames) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var claimed []*job
+	var deferred bool
+	var err error
+	if q.isSQLite() {
+		claimed, deferred, err = q.claimJobsOptimistic(queueName, jobNames, limit)
+	} else {
+		claimed, deferred, err = q.claimJobsLocked(queueName, jobNames, limit)
+	}
+	if err != nil {
+		if len(claimed) == 0 {
+			return nil, err
+		}
+		// jobs claimed before the error are processed instead of
+		// being left processing until their lease expires
+		logrus.Errorf("[qdb] claim jobs of queue %s: %s", queueName, err)
+	}
+
+	if len(claimed) == 0 {
+		if deferred {
+			return nil, errJobDeferred
+		}
+		return nil, gorm.ErrRecordNotFound
+	}
+	return claimed, nil
+}
+
+// claimJobsLocked lock due rows within a transaction, rows locked by other
+// workers are skipped where the database supports SKIP LOCKED
+func (q *queueDB) claimJobsLocked(queueName string, jobNames []string, limit int) ([]*job, bool, error) {
+	var claimed []*job
+	deferred := false
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		candidates, err := q.dueJobs(tx, queueName, jobNames, limit, true)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		// unlimited jobs are marked in one update per visibility timeout
+		unlimited := make(map[time.Duration][]uint)
+		for _, res := range candidates {
+			_, options, _ := q.getHandler(res.JobName)
+			visibilityTimeout := q.visibilityTimeout(options)
+			if options.Limit.enabled() {
+				res.LimitKey = options.Limit.key(res.JobName, res.Payload)
+				delay, err := q.checkJobLimit(tx, options.Limit, res.LimitKey)
+				if err != nil {
+					return err
+				}
+				if delay > 0 {
+					err = tx.Model(&job{}).Where("id = ?", res.ID).Update("run_at", now.Add(delay)).Error
+					if err != nil {
+						return err
 					}
-				} else {
-					_ = q.updateJobStatus(j.ID, statusWaiting)
+					deferred = true
+					continue
 				}
+			}
 
-				timer = time.NewTimer(time.Second * time.Duration(rand.Intn(10)))
-			} else {
-				var deSyncDelay time.Duration
-				if err == gorm.ErrRecordNotFound {
-					deSyncDelay = time.Second * time.Duration(rand.Intn(30))
-				}
-				timer = time.NewTimer(time.Second*10 + deSyncDelay)
+			res.markClaimed(now, visibilityTimeout)
+			claimed = append(claimed, res)
+			if res.LimitKey == "" {
+				unlimited[visibilityTimeout] = append(unlimited[visibilityTimeout], res.ID)
+				continue
 			}
-			break
-		case <-stop:
-			logrus.Info("[qdb] worker loop stopped")
-			return
+
+			// limited job is marked right away so it counts for the next limit check
+			err := tx.Model(&job{}).
+				Where("id = ?", res.ID).
+				Updates(claimJobUpdates(now, visibilityTimeout, res.LimitKey)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for visibilityTimeout, ids := range unlimited {
+			err := tx.Model(&job{}).
+				Where("id IN ?", ids).
+				Updates(claimJobUpdates(now, visibilityTimeout, "")).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return claimed, deferred, nil
+}
+
+// claimJobsOptimistic claim due rows one by one with a conditional update for
+// databases without row locks i.e. sqlite, a row another worker claimed first
+// no longer matches its read status and attempts so it is skipped. limit check
+// runs in a transaction that starts by writing the limit row, sqlite serializes it
+func (q *queueDB) claimJobsOptimistic(queueName string, jobNames []string, limit int) ([]*job, bool, error) {
+	candidates, err := q.dueJobs(q.db, queueName, jobNames, limit, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var claimed []*job
+	deferred := false
+	for _, res := range candidates {
+		now := time.Now()
+		ok := false
+		_, options, _ := q.getHandler(res.JobName)
+		visibilityTimeout := q.visibilityTimeout(options)
+		if options.Limit.enabled() {
+			res.LimitKey = options.Limit.key(res.JobName, res.Payload)
+			err = q.db.Transaction(func(tx *gorm.DB) error {
+				delay, err := q.checkJobLimit(tx, options.Limit, res.LimitKey)
+				if err != nil {
+					return err
+				}
+				if delay > 0 {
+					deferred = true
+					return tx.Model(&job{}).
+						Where("id = ? AND status = ?", res.ID, statusWaiting).
+						Update("run_at", now.Add(delay)).Error
+				}
+				ok, err = q.claimWaitingJob(tx, res, now, visibilityTimeout)
+				return err
+			})
+		} else {
+			ok, err = q.claimWaitingJob(q.db, res, now, visibilityTimeout)
+		}
+		if err != nil {
+			return claimed, deferred, err
+		}
+		if ok {
+			res.markClaimed(now, visibilityTimeout)
+			claimed = append(claimed, res)
 		}
 	}
+	return claimed, deferred, nil
 }
 
-func (q *queueDB) findJobToProcess() (*job, error) {
-	var res job
-	tx := q.db.Begin()
-	err := tx.
-		Clauses(clause.Locking{Strength: "UPDATE"}).
+// claimWaitingJob mark job as processing if it is still as it was read
+func (q *queueDB) claimWaitingJob(tx *gorm.DB, res *job, now time.Time, visibilityTimeout time.Duration) (bool, error) {
+	update := tx.Model(&job{}).
+		Where("id = ? AND status = ? AND attempts = ?", res.ID, statusWaiting, res.Attempts).
+		Updates(claimJobUpdates(now, visibilityTimeout, res.LimitKey))
+	return update.RowsAffected == 1, update.Error
+}
+
+// dueJobs read up to limit due jobs of the queue highest priority first, lock
+// adds claim locking clause to the query
+func (q *queueDB) dueJobs(tx *gorm.DB, queueName string, jobNames []string, limit int, lock bool) ([]*job, error) {
+	query := tx.
 		Where("status = ? AND (run_at <= ? OR run_at IS NULL)", statusWaiting, time.Now()).
-		Limit(1).
-		First(&res).Error
+		Where("queue = ? AND job_name IN ?", queueName, jobNames)
+	if lock {
+		query = query.Clauses(q.claimLocking())
+	}
+
+	if q.options.PriorityOrder == PriorityWeighted {
+		priority, err := q.pickWeightedPriority(tx, queueName, jobNames)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("priority = ?", priority)
+	}
+
+	var candidates []*job
+	err := query.
+		Order("priority DESC, run_at").
+		Limit(limit).
+		Find(&candidates).Error
+	return candidates, err
+}
+
+func (j *job) markClaimed(now time.Time, visibilityTimeout time.Duration) {
+	leaseUntil := now.Add(visibilityTimeout)
+	j.Status = statusProcessing
+	j.Attempts++
+	j.StartedAt = &now
+	j.LeaseUntil = &leaseUntil
+	j.Progress = 0
+	j.ProgressMessage = ""
+}
+
+func claimJobUpdates(now time.Time, visibilityTimeout time.Duration, limitKey string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":           statusProcessing,
+		"last_visited":     now,
+		"lease_until":      now.Add(visibilityTimeout),
+		"attempts":         gorm.Expr("attempts + 1"),
+		"limit_key":        limitKey,
+		"started_at":       now,
+		"progress":         0,
+		"progress_message": "",
+	}
+}
+
+func (q *queueDB) isPostgres() bool {
+	return q.db.Dialector.Name() == "postgres"
+}
+
+func (q *queueDB) isSQLite() bool {
+	return q.db.Dialector.Name() == "sqlite"
+}
+
+// claimLocking lock claimed rows, rows locked by other workers are skipped on postgres and mysql
+func (q *queueDB) claimLocking() clause.Locking {
+	locking := clause.Locking{Strength: "UPDATE"}
+	switch q.db.Dialector.Name() {
+	case "postgres", "mysql":
+		if !q.options.DisableSkipLocked {
+			locking.Options = "SKIP LOCKED"
+		}
+	}
+	return locking
+}
+
+// checkJobLimit return how long the job must be deferred to stay within its limit,
+// zero means it can start now. it locks the limit row until tx ends
+func (q *queueDB) checkJobLimit(tx *gorm.DB, limit JobLimit, limitKey string) (time.Duration, error) {
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&jobLimitLock{LimitKey: limitKey}).Error
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return 0, err
+	}
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("limit_key = ?", limitKey).
+		First(&jobLimitLock{}).Error
+	if err != nil {
+		return 0, err
 	}
 
-	err = tx.Model(&job{}).
-		Where("id = ?", res.ID).
-		Updates(job{Status: statusProcessing, LastVisited: time.Now()}).Error
+	if limit.Concurrency > 0 {
+		var running int64
+		err := tx.Model(&job{}).
+			Where("status = ? AND limit_key = ?", statusProcessing, limitKey).
+			Count(&running).Error
+		if err != nil {
+			return 0, err
+		}
+		if running >= int64(limit.Concurrency) {
+			return limitRetryDelay, nil
+		}
+	}
+
+	if limit.rateEnabled() {
+		now := time.Now()
+		var starts []time.Time
+		err := tx.Model(&job{}).
+			Where("limit_key = ? AND started_at > ?", limitKey, now.Add(-limit.Per)).
+			Pluck("started_at", &starts).Error
+		if err != nil {
+			return 0, err
+		}
+		return limit.rateDelay(starts, now), nil
+	}
+	return 0, nil
+}
+
+// pickWeightedPriority choose one of the priorities of ready jobs, the chance
+// of a priority to be picked is proportional to its value
+func (q *queueDB) pickWeightedPriority(tx *gorm.DB, queueName string, jobNames []string) (int, error) {
+	var priorities []int
+	err := tx.Model(&job{}).
+		Where("status = ? AND (run_at <= ? OR run_at IS NULL)", statusWaiting, time.Now()).
+		Where("queue = ? AND job_name IN ?", queueName, jobNames).
+		Distinct("priority").
+		Pluck("priority", &priorities).Error
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return 0, err
+	}
+	if len(priorities) == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+
+	weight := func(priority int) int {
+		if priority <= 0 {
+			return 1
+		}
+		return priority
+	}
+
+	total := 0
+	for _, priority := range priorities {
+		total += weight(priority)
+	}
+	pick := rand.Intn(total)
+	for _, priority := range priorities {
+		if pick < weight(priority) {
+			return priority, nil
+		}
+		pick -= weight(priority)
+	}
+	return priorities[len(priorities)-1], nil
+}
+
+func (j *job) descriptor() *Job {
+	return &Job{
+		ID:          formatJobID(j.ID),
+		Name:        j.JobName,
+		Payload:     j.Payload,
+		Attempt:     j.Attempts,
+		EnqueuedAt:  j.CreatedAt,
+		ScheduledAt: j.RunAt,
 	}
-	tx.Commit()
-	return &res, nil
+}
+
+func formatJobID(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// completeJob mark job as complete, unique job either keeps blocking
+// duplicates for its uniqueness window or releases its key right away
+func (q *queueDB) completeJob(j *job) error {
+	j.Status = statusComplete
+	updates := map[string]interface{}{"status": j.Status, "result": j.Result, "lease_until": nil}
+	if j.UniqueKey != nil {
+		if j.UniqueFor > 0 {
+			updates["unique_until"] = time.Now().Add(j.UniqueFor)
+		} else {
+			updates["unique_key"] = nil
+		}
+	}
+
+	// attempts no longer match when the job was requeued and claimed again
+	// after its lease expired, the other attempt owns the job now
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(&job{}).
+			Where("id = ? AND attempts = ?", j.ID, j.Attempts).
+			Updates(updates).Error
+	})
 }
 
 func (q *queueDB) updateJobStatus(jobID uint, status string) error {
@@ -216,17 +1026,95 @@ func (q *queueDB) updateJobStatus(jobID uint, status string) error {
 	})
 }
 
-func (q *queueDB) updateLastVisited(jobID uint) error {
+// failJob put failed job back to waiting after backoff delay or mark it
+// as failed when it is not retryable or ran out of attempts
+func (q *queueDB) failJob(j *job, policy RetryPolicy, jobErr error, startedAt time.Time) error {
+	updates := j.failedAttemptUpdates(policy, jobErr)
 	return q.db.Transaction(func(tx *gorm.DB) error {
-		return tx.Model(&job{}).
-			Where("id = ?", jobID).
-			Update("last_visited", time.Now()).Error
+		res := tx.Model(&job{}).
+			Where("id = ? AND attempts = ?", j.ID, j.Attempts).
+			Updates(updates)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		return recordJobAttempt(tx, &jobAttempt{
+			JobID:      j.ID,
+			Error:      jobErr.Error(),
+			StartedAt:  startedAt,
+			FinishedAt: time.Now(),
+		})
 	})
 }
 
+// recordJobAttempt store failed attempt numbered after the attempts already in
+// the history, attempts of a job retried from failed continue the numbering
+func recordJobAttempt(tx *gorm.DB, attempt *jobAttempt) error {
+	var count int64
+	if err := tx.Model(&jobAttempt{}).Where("job_id = ?", attempt.JobID).Count(&count).Error; err != nil {
+		return err
+	}
+	attempt.Attempt = int(count) + 1
+	return tx.Create(attempt).Error
+}
+
+// failedAttemptUpdates columns of job whose attempt failed with jobErr
+func (j *job) failedAttemptUpdates(policy RetryPolicy, jobErr error) map[string]interface{} {
+	j.LastError = jobErr.Error()
+	updates := map[string]interface{}{
+		"last_error":  j.LastError,
+		"lease_until": nil,
+	}
+	if policy.shouldRetry(j.Attempts, jobErr) {
+		j.Status = statusWaiting
+		updates["status"] = j.Status
+		updates["run_at"] = time.Now().Add(policy.backoff(j.Attempts))
+	} else {
+		j.Status = statusFailed
+		updates["status"] = j.Status
+		logrus.Debugf("[qdb] job %s - %d failed after %d attempts: %s", j.JobName, j.ID, j.Attempts, jobErr)
+	}
+	return updates
+}
+
+// extendLease heartbeat of running job
+func (q *queueDB) extendLease(j *job, visibilityTimeout time.Duration) error {
+	now := time.Now()
+	return q.db.Model(&job{}).
+		Where("id = ? AND attempts = ? AND status = ?", j.ID, j.Attempts, statusProcessing).
+		Updates(map[string]interface{}{
+			"last_visited": now,
+			"lease_until":  now.Add(visibilityTimeout),
+		}).Error
+}
+
+// visibilityTimeout of job with options, set by job options, its queue or QueueDBOptions
+func (q *queueDB) visibilityTimeout(options JobOptions) time.Duration {
+	if options.VisibilityTimeout > 0 {
+		return options.VisibilityTimeout
+	}
+	for _, queue := range q.options.Queues {
+		if queue.Name == options.queueName() && queue.VisibilityTimeout > 0 {
+			return queue.VisibilityTimeout
+		}
+	}
+	return q.options.VisibilityTimeout
+}
+
+// heartbeatInterval extend lease at least 3 times within the visibility timeout
+func (q *queueDB) heartbeatInterval(visibilityTimeout time.Duration) time.Duration {
+	if interval := visibilityTimeout / 3; interval < q.options.HeartbeatInterval {
+		return interval
+	}
+	return q.options.HeartbeatInterval
+}
+
 // jobVisitor act as heartbeat to inform that this job is still processing
 type jobVisitor struct {
 	stopChannel chan bool
+
+	// interval between heartbeats, zero means visitingInterval
+	interval time.Duration
 }
 
 func (v *jobVisitor) stop() {
@@ -235,7 +1123,11 @@ func (v *jobVisitor) stop() {
 
 func (v *jobVisitor) startVisiting(onVisiting func()) {
 	for {
-		ticker := time.NewTicker(visitingInterval)
+		interval := v.interval
+		if interval <= 0 {
+			interval = visitingInterval
+		}
+		ticker := time.NewTicker(interval)
 		select {
 		case <-v.stopChannel:
 			ticker.Stop()
@@ -247,7 +1139,18 @@ func (v *jobVisitor) startVisiting(onVisiting func()) {
 	}
 }
 
+// errJobDeferred every due job found was deferred by its JobLimit, fetch loop waits until the next one is due
+var errJobDeferred = errors.New("job deferred by its limit")
+
 const (
-	visitingInterval       = time.Second * 10
-	maxLastVisitedDuration = time.Minute * 15
+	defaultDBPollInterval = time.Second
+	defaultDBBatchSize    = 10
+
+	// minDeferredDelay shortest wait of fetch loop after every due job it
+	// found was deferred, so due jobs it can not claim are not polled busily
+	minDeferredDelay = time.Millisecond * 10
+
+	visitingInterval         = time.Second * 10
+	defaultHeartbeatInterval = visitingInterval
+	defaultVisibilityTimeout = time.Minute * 15
 )
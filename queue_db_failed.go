@@ -0,0 +1,177 @@
+package gocommonweb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// failedDeleteBatchSize failed jobs deleted per transaction, it keeps
+// id lists within bind parameter limits of every database
+const failedDeleteBatchSize = 500
+
+func (q *queueDB) FailedJobs(jobName string, offset int, limit int) ([]FailedJob, error) {
+	// OFFSET without LIMIT is not valid on SQLite and MySQL
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	var jobs []job
+	err := q.failedJobsQuery(q.db, jobName).
+		Order("id").
+		Offset(offset).
+		Limit(limit).
+		Find(&jobs).Error
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+
+	jobIDs := make([]uint, 0, len(jobs))
+	for _, j := range jobs {
+		jobIDs = append(jobIDs, j.ID)
+	}
+
+	var attempts []jobAttempt
+	err = q.db.Where("job_id IN ?", jobIDs).Order("id").Find(&attempts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[uint][]JobAttempt)
+	for _, a := range attempts {
+		history[a.JobID] = append(history[a.JobID], JobAttempt{
+			Attempt:    a.Attempt,
+			Error:      a.Error,
+			StartedAt:  a.StartedAt,
+			FinishedAt: a.FinishedAt,
+		})
+	}
+
+	failedJobs := make([]FailedJob, 0, len(jobs))
+	for _, j := range jobs {
+		failedJobs = append(failedJobs, FailedJob{
+			Job:      *j.descriptor(),
+			Error:    j.LastError,
+			FailedAt: j.UpdatedAt,
+			History:  history[j.ID],
+		})
+	}
+	return failedJobs, nil
+}
+
+func (q *queueDB) RetryFailedJob(id string) error {
+	jobID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+
+	res := q.retryFailedJobs(q.db.Where("id = ?", jobID))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return nil
+}
+
+func (q *queueDB) RetryFailedJobs(jobName string) (int, error) {
+	res := q.retryFailedJobs(q.failedJobsQuery(q.db, jobName))
+	return int(res.RowsAffected), res.Error
+}
+
+func (q *queueDB) retryFailedJobs(tx *gorm.DB) *gorm.DB {
+	res := tx.Model(&job{}).
+		Where("status = ?", statusFailed).
+		Updates(map[string]interface{}{
+			"status":       statusWaiting,
+			"attempts":     0,
+			"run_at":       time.Now(),
+			"last_visited": time.Now(),
+		})
+	if res.Error == nil && res.RowsAffected > 0 {
+		_ = q.jobAdded(q.db, "", time.Now())
+	}
+	return res
+}
+
+func (q *queueDB) DeleteFailedJob(id string) error {
+	jobID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+
+	count, err := q.deleteFailedJobs(q.db.Where("id = ?", jobID))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return nil
+}
+
+func (q *queueDB) DeleteFailedJobs(jobName string) (int, error) {
+	return q.deleteFailedJobs(q.failedJobsQuery(q.db, jobName))
+}
+
+// deleteFailedJobs delete failed jobs matching query with their attempt history
+// in batches of failedDeleteBatchSize
+func (q *queueDB) deleteFailedJobs(query *gorm.DB) (int, error) {
+	query = query.Session(&gorm.Session{})
+	total := 0
+	var lastID uint
+	for {
+		var jobIDs []uint
+		err := query.Model(&job{}).
+			Where("status = ? AND id > ?", statusFailed, lastID).
+			Order("id").
+			Limit(failedDeleteBatchSize).
+			Pluck("id", &jobIDs).Error
+		if err != nil || len(jobIDs) == 0 {
+			return total, err
+		}
+
+		var count int64
+		err = q.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("job_id IN ?", jobIDs).Delete(&jobAttempt{}).Error; err != nil {
+				return err
+			}
+
+			res := tx.Unscoped().Where("id IN ? AND status = ?", jobIDs, statusFailed).Delete(&job{})
+			count = res.RowsAffected
+			return res.Error
+		})
+		total += int(count)
+		if err != nil || len(jobIDs) < failedDeleteBatchSize {
+			return total, err
+		}
+		lastID = jobIDs[len(jobIDs)-1]
+	}
+}
+
+func (q *queueDB) ExportFailedJobs(w io.Writer, jobName string) error {
+	return exportFailedJobs(w, func(offset int, limit int) ([]FailedJob, error) {
+		return q.FailedJobs(jobName, offset, limit)
+	})
+}
+
+func (q *queueDB) failedJobsQuery(tx *gorm.DB, jobName string) *gorm.DB {
+	tx = tx.Where("status = ?", statusFailed)
+	if jobName != "" {
+		tx = tx.Where("job_name = ?", jobName)
+	}
+	return tx
+}
+
+func parseJobID(id string) (uint, error) {
+	jobID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid job id %s", id)
+	}
+	return uint(jobID), nil
+}
@@ -0,0 +1,109 @@
+package gocommonweb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// idle workers poll for due jobs every PollInterval, they are woken earlier
+// when a job is added by this process or, on postgres, when another process
+// sends NOTIFY on queueDBNotifyChannel with the queue name as payload
+
+const (
+	queueDBNotifyChannel = "gocommonweb_jobs"
+	listenRetryDelay     = time.Second * 5
+)
+
+// jobAdded wake workers of queueName for a job already committed, empty name
+// wakes every queue
+func (q *queueDB) jobAdded(tx *gorm.DB, queueName string, runAt time.Time) error {
+	if err := q.notifyJobAdded(tx, queueName, runAt); err != nil {
+		return err
+	}
+	if !runAt.After(time.Now()) {
+		q.wakeWorkers(queueName)
+	}
+	return nil
+}
+
+// notifyJobAdded send NOTIFY with tx on postgres so workers of every process are
+// woken once tx commits. workers of this process are not woken right away as
+// they would not see the uncommitted job
+func (q *queueDB) notifyJobAdded(tx *gorm.DB, queueName string, runAt time.Time) error {
+	if runAt.After(time.Now()) || !q.isPostgres() {
+		return nil
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", queueDBNotifyChannel, queueName).Error
+}
+
+func (q *queueDB) wakeWorkers(queueName string) {
+	for name, wake := range q.wake {
+		if queueName != "" && name != queueName {
+			continue
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startListenLoop LISTEN for jobs added by other processes on a dedicated
+// connection, it needs the pgx driver gorm postgres driver uses by default
+func (q *queueDB) startListenLoop() {
+	defer q.loopsWaitGroup.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-q.stopChan
+		cancel()
+	}()
+
+	for {
+		err := q.listen(ctx)
+		if ctx.Err() != nil {
+			logrus.Info("[qdb] listen loop stopped")
+			return
+		}
+		if errors.Is(err, stdlib.ErrNotPgx) {
+			logrus.Warn("[qdb] database driver is not pgx, workers only poll for new jobs")
+			return
+		}
+		logrus.Errorf("[qdb] listen for new jobs: %s", err)
+
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *queueDB) listen(ctx context.Context) error {
+	sqlDB, err := q.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := stdlib.AcquireConn(sqlDB)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = stdlib.ReleaseConn(sqlDB, conn)
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+queueDBNotifyChannel); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		q.wakeWorkers(notification.Payload)
+	}
+}
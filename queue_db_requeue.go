@@ -0,0 +1,118 @@
+package gocommonweb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ErrJobLeaseExpired error recorded for attempt whose worker stopped sending
+// heartbeat e.g. the process crashed, the job is retried per its RetryPolicy
+var ErrJobLeaseExpired = errors.New("job visibility timeout exceeded")
+
+const requeueBatchSize = 100
+
+// startJobRequeueLoop look for jobs with expired lease every HeartbeatInterval
+func (q *queueDB) startJobRequeueLoop() {
+	defer q.loopsWaitGroup.Done()
+	ticker := time.NewTicker(q.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		count, err := q.requeueStaleJobs()
+		if err != nil {
+			logrus.Errorf("[qdb] requeue stale jobs: %s", err)
+		}
+		if count > 0 {
+			logrus.Infof("[qdb] %d stale jobs requeued", count)
+			q.wakeWorkers("")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.stopChan:
+			logrus.Info("[qdb] requeue loop stopped")
+			return
+		}
+	}
+}
+
+// requeueStaleJobs fail current attempt of every processing job whose lease
+// expired, jobs claimed before leases were stored fall back to last_visited
+func (q *queueDB) requeueStaleJobs() (int, error) {
+	total := 0
+	var lastID uint
+	for {
+		now := time.Now()
+		var stale []*job
+		err := q.db.
+			Where("status = ? AND id > ?", statusProcessing, lastID).
+			Where("lease_until <= ? OR (lease_until IS NULL AND last_visited <= ?)",
+				now, now.Add(-q.options.VisibilityTimeout)).
+			Order("id").
+			Limit(requeueBatchSize).
+			Find(&stale).Error
+		if err != nil {
+			return total, err
+		}
+
+		for _, j := range stale {
+			ok, err := q.requeueStaleJob(j, now)
+			if err != nil {
+				return total, err
+			}
+			if ok {
+				total++
+			}
+		}
+		if len(stale) < requeueBatchSize {
+			return total, nil
+		}
+		lastID = stale[len(stale)-1].ID
+	}
+}
+
+// requeueStaleJob record failed attempt of stale job, false is returned when
+// its worker finished it or extended the lease in the meantime
+func (q *queueDB) requeueStaleJob(j *job, now time.Time) (bool, error) {
+	_, options, _ := q.getHandler(j.JobName)
+	updates := j.failedAttemptUpdates(options.Retry, ErrJobLeaseExpired)
+	requeued := false
+	err := q.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&job{}).
+			Where("id = ? AND status = ? AND attempts = ?", j.ID, statusProcessing, j.Attempts).
+			Where("lease_until <= ? OR lease_until IS NULL", now).
+			Updates(updates)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		requeued = true
+
+		startedAt := j.LastVisited
+		if j.StartedAt != nil {
+			startedAt = *j.StartedAt
+		}
+		return recordJobAttempt(tx, &jobAttempt{
+			JobID:      j.ID,
+			Error:      ErrJobLeaseExpired.Error(),
+			StartedAt:  startedAt,
+			FinishedAt: now,
+		})
+	})
+	if err != nil || !requeued {
+		return false, err
+	}
+
+	logrus.Debugf("[qdb] requeue stale job %s - %d as %s", j.JobName, j.ID, j.Status)
+	q.publishCurrentStatus(formatJobID(j.ID), q.GetJobStatus)
+	if j.Status == statusFailed {
+		q.handlerMutex.Lock()
+		callback := q.lostCallbacks[j.JobName]
+		q.handlerMutex.Unlock()
+		if callback != nil {
+			callback(j.descriptor(), ErrJobLeaseExpired)
+		}
+	}
+	return true, nil
+}
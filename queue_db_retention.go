@@ -0,0 +1,171 @@
+package gocommonweb
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRetentionInterval  = time.Minute * 10
+	defaultRetentionBatchSize = 500
+)
+
+// QueueDBRetention how long finished jobs are kept before janitor deletes them,
+// zero duration keeps jobs of that status forever
+type QueueDBRetention struct {
+	CompletedFor time.Duration
+	FailedFor    time.Duration
+
+	// Interval between janitor runs, default 10 minutes
+	Interval time.Duration
+
+	// BatchSize rows deleted per transaction so the jobs table
+	// is not locked for long, default 500
+	BatchSize int
+
+	// Archive copy jobs with their result and last error to archived_jobs
+	// table before deleting them, attempt history is not archived
+	Archive bool
+}
+
+func (r QueueDBRetention) enabled() bool {
+	return r.CompletedFor > 0 || r.FailedFor > 0
+}
+
+func (r QueueDBRetention) interval() time.Duration {
+	if r.Interval <= 0 {
+		return defaultRetentionInterval
+	}
+	return r.Interval
+}
+
+func (r QueueDBRetention) batchSize() int {
+	if r.BatchSize <= 0 {
+		return defaultRetentionBatchSize
+	}
+	return r.BatchSize
+}
+
+// archivedJob finished job moved out of jobs table, attempt history is not kept
+// only the error of the last attempt
+type archivedJob struct {
+	ID         uint   `gorm:"primarykey"`
+	JobName    string `gorm:"index"`
+	Payload    string
+	Queue      string
+	Priority   int
+	Status     string `gorm:"index"`
+	Attempts   int
+	LastError  string
+	Result     string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	ArchivedAt time.Time `gorm:"index"`
+}
+
+func (q *queueDB) startJanitorLoop() {
+	defer q.loopsWaitGroup.Done()
+	ticker := time.NewTicker(q.options.Retention.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := q.pruneJobs(); err != nil {
+				logrus.Errorf("[qdb] prune jobs: %s", err)
+			}
+		case <-q.stopChan:
+			logrus.Info("[qdb] janitor loop stopped")
+			return
+		}
+	}
+}
+
+// pruneJobs delete completed and failed jobs older than their retention
+func (q *queueDB) pruneJobs() (int, error) {
+	retention := q.options.Retention
+	total := 0
+	if retention.CompletedFor > 0 {
+		count, err := q.pruneJobsWithStatus(statusComplete, time.Now().Add(-retention.CompletedFor))
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	if retention.FailedFor > 0 {
+		count, err := q.pruneJobsWithStatus(statusFailed, time.Now().Add(-retention.FailedFor))
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	if total > 0 {
+		logrus.Debugf("[qdb] pruned %d jobs", total)
+	}
+	return total, nil
+}
+
+func (q *queueDB) pruneJobsWithStatus(status string, finishedBefore time.Time) (int, error) {
+	batchSize := q.options.Retention.batchSize()
+	total := 0
+	for {
+		var jobIDs []uint
+		// completed unique jobs are kept while their uniqueness window is
+		// still open, status and updated_at are covered by idx_jobs_retention
+		err := q.db.Model(&job{}).
+			Where("status = ? AND updated_at < ?", status, finishedBefore).
+			Where("unique_until IS NULL OR unique_until < ?", time.Now()).
+			Order("id").
+			Limit(batchSize).
+			Pluck("id", &jobIDs).Error
+		if err != nil || len(jobIDs) == 0 {
+			return total, err
+		}
+
+		var count int64
+		err = q.db.Transaction(func(tx *gorm.DB) error {
+			if q.options.Retention.Archive {
+				if err := archiveJobs(tx, jobIDs); err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("job_id IN ?", jobIDs).Delete(&jobAttempt{}).Error; err != nil {
+				return err
+			}
+			res := tx.Unscoped().Where("id IN ? AND status = ?", jobIDs, status).Delete(&job{})
+			count = res.RowsAffected
+			return res.Error
+		})
+		total += int(count)
+		if err != nil || len(jobIDs) < batchSize {
+			return total, err
+		}
+	}
+}
+
+func archiveJobs(tx *gorm.DB, jobIDs []uint) error {
+	var jobs []job
+	if err := tx.Unscoped().Where("id IN ?", jobIDs).Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	archived := make([]archivedJob, 0, len(jobs))
+	for _, j := range jobs {
+		archived = append(archived, archivedJob{
+			ID:         j.ID,
+			JobName:    j.JobName,
+			Payload:    j.Payload,
+			Queue:      j.Queue,
+			Priority:   j.Priority,
+			Status:     j.Status,
+			Attempts:   j.Attempts,
+			LastError:  j.LastError,
+			Result:     j.Result,
+			CreatedAt:  j.CreatedAt,
+			FinishedAt: j.UpdatedAt,
+			ArchivedAt: time.Now(),
+		})
+	}
+	return tx.Create(&archived).Error
+}
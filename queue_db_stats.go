@@ -0,0 +1,61 @@
+package gocommonweb
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Stats count jobs grouped by queue, job name and status, then look up the
+// oldest due job of every group with waiting jobs. both queries are covered
+// by the (status, queue, job_name, run_at) index
+func (q *queueDB) Stats() ([]JobStats, error) {
+	var groups []struct {
+		Queue   string
+		JobName string
+		Status  string
+		Count   int64
+	}
+	err := q.db.Model(&job{}).
+		Select("status, queue, job_name, COUNT(*) AS count").
+		Where("status IN ?", []string{statusWaiting, statusProcessing, statusFailed}).
+		Group("status, queue, job_name").
+		Scan(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	set := make(jobStatsSet)
+	for _, group := range groups {
+		stats := set.get(group.Queue, group.JobName)
+		switch group.Status {
+		case statusWaiting:
+			stats.Waiting = group.Count
+			oldest, err := q.oldestDueJob(group.Queue, group.JobName, now)
+			if err != nil {
+				return nil, err
+			}
+			stats.OldestWaiting = oldestWaiting(oldest, now)
+		case statusProcessing:
+			stats.Processing = group.Count
+		case statusFailed:
+			stats.Failed = group.Count
+		}
+	}
+	return q.mergeAttempts(set), nil
+}
+
+// oldestDueJob run time of the oldest waiting job due by now, zero when there is none
+func (q *queueDB) oldestDueJob(queueName string, jobName string, now time.Time) (time.Time, error) {
+	var oldest job
+	err := q.db.
+		Select("run_at").
+		Where("status = ? AND queue = ? AND job_name = ? AND run_at <= ?", statusWaiting, queueName, jobName, now).
+		Order("run_at").
+		Take(&oldest).Error
+	if err == gorm.ErrRecordNotFound {
+		return time.Time{}, nil
+	}
+	return oldest.RunAt, err
+}
@@ -0,0 +1,56 @@
+package gocommonweb
+
+import (
+	"gorm.io/gorm"
+)
+
+func (q *queueDB) GetJobStatus(id string) (*JobStatus, error) {
+	jobID, err := parseJobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var j job
+	err = q.db.Where("id = ?", jobID).First(&j).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	status := j.jobStatus()
+	return &status, nil
+}
+
+// updateProgress store progress of running job, it is ignored once
+// the job is no longer processing e.g. it was put back by Shutdown.
+// status is the job status when the attempt started
+func (q *queueDB) updateProgress(jobID uint, status JobStatus, pct int, message string) error {
+	err := q.db.Model(&job{}).
+		Where("id = ? AND status = ?", jobID, statusProcessing).
+		Updates(map[string]interface{}{"progress": pct, "progress_message": message}).Error
+	if err != nil {
+		return err
+	}
+
+	status.Progress = pct
+	status.ProgressMessage = message
+	q.publishStatus(status)
+	return nil
+}
+
+func (j *job) jobStatus() JobStatus {
+	status := JobStatus{
+		ID:              formatJobID(j.ID),
+		Name:            j.JobName,
+		Status:          j.Status,
+		Attempt:         j.Attempts,
+		Progress:        j.Progress,
+		ProgressMessage: j.ProgressMessage,
+		Result:          j.Result,
+	}
+	if j.Status != statusComplete {
+		status.Error = j.LastError
+	}
+	return status
+}
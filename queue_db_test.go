@@ -0,0 +1,849 @@
+package gocommonweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	return db
+}
+
+func insertFailedJob(t *testing.T, db *gorm.DB, jobName string, attempts int) job {
+	j := job{
+		JobName:   jobName,
+		Payload:   "payload",
+		Status:    statusFailed,
+		RunAt:     time.Now(),
+		Attempts:  attempts,
+		LastError: "boom",
+	}
+	require.NoError(t, db.Create(&j).Error)
+	for i := 1; i <= attempts; i++ {
+		require.NoError(t, db.Create(&jobAttempt{JobID: j.ID, Attempt: i, Error: "boom"}).Error)
+	}
+	return j
+}
+
+func TestQueueDBFailedJobs(t *testing.T) {
+	db := openTestDB(t)
+	queue, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+
+	first := insertFailedJob(t, db, "send_email", 3)
+	insertFailedJob(t, db, "send_email", 2)
+	insertFailedJob(t, db, "resize_image", 1)
+
+	failedJobs, err := queue.FailedJobs("send_email", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 2)
+	require.Equal(t, "boom", failedJobs[0].Error)
+	require.Len(t, failedJobs[0].History, 3)
+
+	failedJobs, err = queue.FailedJobs("", 1, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 2)
+
+	var buf bytes.Buffer
+	require.NoError(t, queue.ExportFailedJobs(&buf, ""))
+	var exported FailedJob
+	require.NoError(t, json.NewDecoder(&buf).Decode(&exported))
+	require.Equal(t, "send_email", exported.Name)
+
+	require.NoError(t, queue.RetryFailedJob(formatJobID(first.ID)))
+	require.Error(t, queue.RetryFailedJob(formatJobID(first.ID)))
+
+	var retried job
+	require.NoError(t, db.First(&retried, first.ID).Error)
+	require.Equal(t, statusWaiting, retried.Status)
+	require.Equal(t, 0, retried.Attempts)
+
+	count, err := queue.DeleteFailedJobs("send_email")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	count, err = queue.RetryFailedJobs("")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	failedJobs, err = queue.FailedJobs("", 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, failedJobs)
+}
+
+func TestQueueDBFailedJobsBulk(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	imports := make([]job, failedDeleteBatchSize+1)
+	for i := range imports {
+		imports[i] = job{JobName: "import", Status: statusFailed, RunAt: time.Now()}
+	}
+	require.NoError(t, db.CreateInBatches(&imports, 100).Error)
+	insertFailedJob(t, db, "send_email", 1)
+
+	// offset without limit
+	failedJobs, err := queue.FailedJobs("", 1, 0)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, failedDeleteBatchSize+1)
+
+	count, err := queue.DeleteFailedJobs("import")
+	require.NoError(t, err)
+	require.Equal(t, failedDeleteBatchSize+1, count)
+	failedJobs, err = queue.FailedJobs("", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+
+	// attempts of a retried job continue its history
+	queue.SetJobOptions("call_api", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errors.New("boom")
+	}))
+	require.NoError(t, queue.AddJob("call_api", ""))
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+	count, err = queue.RetryFailedJobs("call_api")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	j, err = queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+
+	failedJobs, err = queue.FailedJobs("call_api", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Equal(t, 1, failedJobs[0].Attempt)
+	require.Len(t, failedJobs[0].History, 2)
+	require.Equal(t, 1, failedJobs[0].History[0].Attempt)
+	require.Equal(t, 2, failedJobs[0].History[1].Attempt)
+}
+
+func TestQueueDBUniqueJob(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	enqueued, err := queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-2", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	var first job
+	require.NoError(t, db.Where("payload = ?", "user-1").First(&first).Error)
+	require.NoError(t, queue.completeJob(&first))
+
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	// explicit key with uniqueness window after completion
+	options := UniqueOptions{Key: "daily-report", Window: time.Hour}
+	enqueued, err = queue.AddUniqueJob("report", "a", options)
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	var report job
+	require.NoError(t, db.Where("job_name = ?", "report").First(&report).Error)
+	require.NoError(t, queue.completeJob(&report))
+
+	enqueued, err = queue.AddUniqueJob("report", "b", options)
+	require.NoError(t, err)
+	require.False(t, enqueued)
+
+	// failed job blocks duplicates again once retried
+	enqueued, err = queue.AddUniqueJob("import", "a", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	var imported job
+	require.NoError(t, db.Where("job_name = ?", "import").First(&imported).Error)
+	imported.Attempts = 1
+	require.NoError(t, db.Model(&imported).Update("attempts", 1).Error)
+	require.NoError(t, queue.failJob(&imported, RetryPolicy{MaxAttempts: 1}, errors.New("boom"), time.Now()))
+	require.NoError(t, queue.RetryFailedJob(formatJobID(imported.ID)))
+	enqueued, err = queue.AddUniqueJob("import", "a", UniqueOptions{})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+}
+
+func TestQueueDBPriorityAndNamedQueues(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDBWithOptions(db, QueueDBOptions{
+		Queues: []WorkerQueue{
+			{Name: DefaultQueueName, Workers: 1},
+			{Name: "critical", Workers: 1},
+		},
+	})
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	handler := JobContextHandlerFunc(func(ctx context.Context, job *Job) error { return nil })
+	queue.SetJobOptions("password_reset", JobOptions{Queue: "critical"})
+	queue.SetJobOptions("bulk_email", JobOptions{Priority: 1})
+	queue.SetJobOptions("invoice_email", JobOptions{Priority: 10})
+	for _, name := range []string{"password_reset", "bulk_email", "invoice_email"} {
+		queue.AddJobContextHandler(name, handler)
+	}
+
+	require.NoError(t, queue.AddJob("bulk_email", "1"))
+	require.NoError(t, queue.AddJob("password_reset", "2"))
+	require.NoError(t, queue.AddJob("invoice_email", "3"))
+
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	require.Equal(t, "invoice_email", j.JobName)
+
+	j, err = queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	require.Equal(t, "bulk_email", j.JobName)
+
+	_, err = queue.findJobToProcess(DefaultQueueName)
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	j, err = queue.findJobToProcess("critical")
+	require.NoError(t, err)
+	require.Equal(t, "password_reset", j.JobName)
+}
+
+func TestQueueDBShutdown(t *testing.T) {
+	db := openTestDB(t)
+	queue, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+
+	// shutdown a queue that never started must not block
+	unstarted, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	unstarted.Close()
+
+	started := make(chan string, 1)
+	queue.AddJobContextHandler("import", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		started <- job.ID
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	require.NoError(t, queue.AddJob("import", "file.csv"))
+	queue.Start()
+
+	var jobID string
+	select {
+	case jobID = <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("job not started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, queue.Shutdown(ctx))
+
+	var j job
+	require.NoError(t, db.First(&j, jobID).Error)
+	require.Equal(t, statusWaiting, j.Status)
+	require.Equal(t, 0, j.Attempts)
+	require.Empty(t, j.LastError)
+}
+
+func TestQueueDBJobTimeout(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	release := make(chan bool)
+	defer close(release)
+	queue.SetJobOptions("stuck", JobOptions{
+		Timeout:      time.Millisecond * 50,
+		TimeoutGrace: time.Millisecond * 20,
+		Retry:        RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(0)},
+	})
+	queue.AddJobContextHandler("stuck", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		// ignores cancellation on purpose
+		<-release
+		return nil
+	}))
+	require.NoError(t, queue.AddJob("stuck", ""))
+
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+
+	var res job
+	require.NoError(t, db.First(&res, j.ID).Error)
+	require.Equal(t, statusWaiting, res.Status)
+	require.Contains(t, res.LastError, ErrJobTimeout.Error())
+
+	j, err = queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+
+	require.NoError(t, db.First(&res, j.ID).Error)
+	require.Equal(t, statusFailed, res.Status)
+
+	var attempts []jobAttempt
+	require.NoError(t, db.Where("job_id = ?", j.ID).Find(&attempts).Error)
+	require.Len(t, attempts, 2)
+}
+
+func TestQueueDBHandlerPanic(t *testing.T) {
+	db := openTestDB(t)
+	queue, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	handled := make(chan string, 2)
+	queue.SetJobOptions("explode", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("explode", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled <- job.ID
+		panic("boom")
+	}))
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled <- job.ID
+		return nil
+	}))
+	require.NoError(t, queue.AddJob("explode", ""))
+	queue.Start()
+
+	receive := func() string {
+		select {
+		case id := <-handled:
+			return id
+		case <-time.After(time.Second * 5):
+			t.Fatal("job not handled")
+			return ""
+		}
+	}
+	panicked := receive()
+
+	// worker keeps running after the panic
+	require.NoError(t, queue.AddJob("send_email", ""))
+	receive()
+
+	require.Eventually(t, func() bool {
+		var j job
+		return db.First(&j, panicked).Error == nil && j.Status == statusFailed
+	}, time.Second*5, time.Millisecond*10)
+	failedJobs, err := queue.FailedJobs("explode", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Equal(t, panicked, failedJobs[0].ID)
+	require.Contains(t, failedJobs[0].Error, "job panic: boom")
+	require.Len(t, failedJobs[0].History, 1)
+}
+
+func TestQueueDBPruneJobs(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDBWithOptions(db, QueueDBOptions{
+		Queues: []WorkerQueue{{Name: DefaultQueueName, Workers: 1}},
+		Retention: QueueDBRetention{
+			CompletedFor: time.Hour,
+			FailedFor:    time.Hour * 24,
+			BatchSize:    2,
+			Archive:      true,
+		},
+	})
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	require.True(t, db.Migrator().HasIndex(&job{}, "idx_jobs_retention"))
+
+	old := time.Now().Add(-time.Hour * 2)
+	for i := 0; i < 3; i++ {
+		j := job{JobName: "send_email", Status: statusComplete, RunAt: old, Result: "sent"}
+		require.NoError(t, db.Create(&j).Error)
+		require.NoError(t, db.Model(&j).UpdateColumn("updated_at", old).Error)
+	}
+	recent := job{JobName: "send_email", Status: statusComplete, RunAt: time.Now()}
+	require.NoError(t, db.Create(&recent).Error)
+	failed := insertFailedJob(t, db, "send_email", 2)
+	require.NoError(t, db.Model(&failed).UpdateColumn("updated_at", old).Error)
+
+	count, err := queue.pruneJobs()
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	var remaining int64
+	require.NoError(t, db.Unscoped().Model(&job{}).Count(&remaining).Error)
+	require.Equal(t, int64(2), remaining)
+
+	var archived []archivedJob
+	require.NoError(t, db.Find(&archived).Error)
+	require.Len(t, archived, 3)
+	require.Equal(t, statusComplete, archived[0].Status)
+	require.Equal(t, "sent", archived[0].Result)
+}
+
+func TestQueueDBJobLimit(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	queue.SetJobOptions("sync_account", JobOptions{Limit: JobLimit{
+		Concurrency:  1,
+		PartitionKey: func(payload string) string { return payload },
+	}})
+	queue.SetJobOptions("call_api", JobOptions{Limit: JobLimit{Rate: 1, Per: time.Hour}})
+	handler := JobContextHandlerFunc(func(ctx context.Context, job *Job) error { return nil })
+	queue.AddJobContextHandler("sync_account", handler)
+	queue.AddJobContextHandler("call_api", handler)
+
+	require.NoError(t, queue.AddJob("sync_account", "account-1"))
+	require.NoError(t, queue.AddJob("sync_account", "account-1"))
+	require.NoError(t, queue.AddJob("sync_account", "account-2"))
+
+	first, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	require.Equal(t, "account-1", first.Payload)
+
+	// second job of account-1 is deferred without using up an attempt
+	_, err = queue.findJobToProcess(DefaultQueueName)
+	require.Equal(t, errJobDeferred, err)
+
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	require.Equal(t, "account-2", j.Payload)
+
+	var deferred job
+	require.NoError(t, db.Where("status = ?", statusWaiting).First(&deferred).Error)
+	require.Equal(t, 0, deferred.Attempts)
+	require.True(t, deferred.RunAt.After(time.Now()))
+
+	require.NoError(t, queue.AddJob("call_api", "1"))
+	require.NoError(t, queue.AddJob("call_api", "2"))
+	j, err = queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+
+	_, err = queue.findJobToProcess(DefaultQueueName)
+	require.Equal(t, errJobDeferred, err)
+	var throttled job
+	require.NoError(t, db.Where("job_name = ? AND status = ?", "call_api", statusWaiting).First(&throttled).Error)
+	require.True(t, throttled.RunAt.After(time.Now().Add(time.Minute*59)))
+}
+
+func TestQueueDBNextDueDelay(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return nil
+	}))
+
+	require.Equal(t, time.Minute, queue.nextDueDelay(DefaultQueueName, time.Minute))
+	_, err = queue.AddJobAt("call_api", "", time.Now().Add(time.Second*30))
+	require.NoError(t, err)
+	require.InDelta(t, time.Second*30, queue.nextDueDelay(DefaultQueueName, time.Minute), float64(time.Second))
+	require.Equal(t, time.Second, queue.nextDueDelay(DefaultQueueName, time.Second))
+
+	// due job the fetch loop could not claim is not polled in a busy loop
+	require.NoError(t, queue.AddJob("call_api", ""))
+	require.Equal(t, minDeferredDelay, queue.nextDueDelay(DefaultQueueName, time.Minute))
+}
+
+func TestQueueDBScheduleAndCancel(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	queue.AddJobContextHandler("reminder", JobContextHandlerFunc(func(ctx context.Context, job *Job) error { return nil }))
+
+	appointment := time.Now().Add(time.Hour * 48)
+	id, err := queue.AddJobAt("reminder", "appointment-1", appointment.Add(-time.Hour*24))
+	require.NoError(t, err)
+
+	_, err = queue.findJobToProcess(DefaultQueueName)
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	require.NoError(t, queue.Reschedule(id, time.Now().Add(-time.Second)))
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	require.Equal(t, id, formatJobID(j.ID))
+
+	// processing job can't be cancelled
+	require.Equal(t, ErrJobNotPending, queue.CancelJob(id))
+
+	id, err = queue.AddJobAt("reminder", "appointment-2", appointment)
+	require.NoError(t, err)
+	require.NoError(t, queue.CancelJob(id))
+	require.Equal(t, ErrJobNotPending, queue.CancelJob(id))
+	require.Equal(t, ErrJobNotPending, queue.Reschedule(id, time.Now()))
+}
+
+func TestQueueDBJobDescriptor(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	var seen []Job
+	handler := &recordedJobHandler{}
+	queue.SetJobOptions("send_email", JobOptions{Retry: RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(0)}})
+	queue.AddJobHandler("send_email", handler)
+	queue.Use(func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			seen = append(seen, *job)
+			if job.Attempt == 1 {
+				return errors.New("smtp down")
+			}
+			return next.HandleJob(ctx, job)
+		})
+	})
+
+	enqueuedAt := time.Now()
+	runAt := enqueuedAt.Add(-time.Minute)
+	id, err := queue.AddJobAt("send_email", "a@example.com", runAt)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		j, err := queue.findJobToProcess(DefaultQueueName)
+		require.NoError(t, err)
+		queue.processJob(j)
+	}
+	require.Equal(t, []string{"send_email:a@example.com"}, handler.calls)
+
+	// retry gets the next attempt number and its own schedule
+	require.Len(t, seen, 2)
+	for i, descriptor := range seen {
+		require.Equal(t, id, descriptor.ID)
+		require.Equal(t, "send_email", descriptor.Name)
+		require.Equal(t, "a@example.com", descriptor.Payload)
+		require.Equal(t, i+1, descriptor.Attempt)
+		require.Equal(t, 3, descriptor.MaxAttempts)
+		require.WithinDuration(t, enqueuedAt, descriptor.EnqueuedAt, time.Second)
+	}
+	require.WithinDuration(t, runAt, seen[0].ScheduledAt, time.Millisecond)
+	require.True(t, seen[1].ScheduledAt.After(seen[0].ScheduledAt))
+
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobComplete, status.Status)
+	require.Equal(t, 2, status.Attempt)
+}
+
+func TestQueueDBStats(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	queue.SetJobOptions("send_email", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		if job.Payload == "fail" {
+			return fmt.Errorf("smtp down")
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.Create(&job{JobName: "send_email", Payload: "ok", Queue: DefaultQueueName, Status: statusWaiting, RunAt: time.Now().Add(-time.Minute)}).Error)
+	require.NoError(t, db.Create(&job{JobName: "send_email", Payload: "fail", Queue: DefaultQueueName, Status: statusWaiting, RunAt: time.Now().Add(-time.Second)}).Error)
+	require.NoError(t, queue.AddDelayedJob("send_email", "later", 3600))
+
+	stats, err := queue.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Equal(t, int64(3), stats[0].Waiting)
+	require.True(t, stats[0].OldestWaiting >= time.Minute)
+
+	for i := 0; i < 2; i++ {
+		j, err := queue.findJobToProcess(DefaultQueueName)
+		require.NoError(t, err)
+		queue.processJob(j)
+	}
+
+	stats, err = queue.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Equal(t, int64(1), stats[0].Waiting)
+	require.Equal(t, int64(1), stats[0].Failed)
+	require.Equal(t, time.Duration(0), stats[0].OldestWaiting)
+	require.Equal(t, int64(1), stats[0].Succeeded)
+	require.Equal(t, int64(1), stats[0].FailedAttempts)
+	require.Equal(t, 0.5, stats[0].SuccessRate())
+	require.True(t, stats[0].AvgLatency() >= time.Second)
+
+	// waiting, processing and failed gauges of send_email
+	require.Equal(t, 3, testutil.CollectAndCount(NewQueueCollector(queue, "test"), "test_queue_jobs"))
+}
+
+func TestQueueDBJobStatus(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	queue.SetJobOptions("import_csv", JobOptions{Retry: RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(0)}})
+	queue.AddJobContextHandler("import_csv", JobResultHandlerFunc(func(ctx context.Context, job *Job) (string, error) {
+		if err := job.ReportProgress(150, "rows imported"); err != nil {
+			return "", err
+		}
+		if job.Attempt == 1 {
+			return "", fmt.Errorf("connection reset")
+		}
+		return "10 rows", nil
+	}))
+
+	id, err := queue.AddJobAt("import_csv", "users.csv", time.Now())
+	require.NoError(t, err)
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobWaiting, status.Status)
+
+	j, err := queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+	status, err = queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobWaiting, status.Status)
+	require.Equal(t, 100, status.Progress)
+	require.Equal(t, "connection reset", status.Error)
+
+	j, err = queue.findJobToProcess(DefaultQueueName)
+	require.NoError(t, err)
+	queue.processJob(j)
+	status, err = queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobComplete, status.Status)
+	require.Equal(t, 2, status.Attempt)
+	require.Equal(t, "10 rows", status.Result)
+	require.Empty(t, status.Error)
+
+	_, err = queue.GetJobStatus("12345")
+	require.Equal(t, ErrJobNotFound, err)
+}
+
+func TestQueueDBAddJobTx(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	wake := queue.wake[DefaultQueueName]
+
+	errRollback := fmt.Errorf("rollback")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, queue.AddJobTx(tx, "send_email", "rolled back"))
+		return errRollback
+	})
+	require.Equal(t, errRollback, err)
+
+	// workers are not woken before the job is committed
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := queue.AddJobTx(tx.Where("1 = 0"), "send_email", "committed")
+		require.Len(t, wake, 0)
+		return err
+	})
+	require.NoError(t, err)
+	queue.WakeWorkers()
+	require.Len(t, wake, 1)
+	<-wake
+
+	var payloads []string
+	require.NoError(t, db.Model(&job{}).Pluck("payload", &payloads).Error)
+	require.Equal(t, []string{"committed"}, payloads)
+
+	enqueued, err := queue.AddUniqueJob("send_email", "unique", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	require.Len(t, wake, 1)
+	<-wake
+	require.NoError(t, queue.AddJob("send_email", "plain"))
+	require.Len(t, wake, 1)
+}
+
+func TestQueueDBClaimBatchAndWakeUp(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDBWithOptions(db, QueueDBOptions{
+		Queues:       []WorkerQueue{{Name: DefaultQueueName, Workers: 2}},
+		PollInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+
+	handled := make(chan string, 10)
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled <- job.Payload
+		return nil
+	}))
+
+	require.NoError(t, queue.AddDelayedJob("send_email", "later", 3600))
+	require.NoError(t, queue.AddJob("send_email", "first"))
+	require.NoError(t, queue.AddJob("send_email", "second"))
+	require.NoError(t, queue.AddJob("send_email", "third"))
+	claimed, err := queue.claimJobs(DefaultQueueName, 2)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	require.Equal(t, "first", claimed[0].Payload)
+	require.Equal(t, "second", claimed[1].Payload)
+	require.NoError(t, queue.putBackJobs([]uint{claimed[0].ID, claimed[1].ID}))
+
+	queue.Start()
+	defer queue.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 5):
+			t.Fatal("jobs not handled")
+		}
+	}
+
+	// workers are woken by the new job long before the next poll
+	require.NoError(t, queue.AddJob("send_email", "new"))
+	select {
+	case payload := <-handled:
+		require.Equal(t, "new", payload)
+	case <-time.After(time.Second * 5):
+		t.Fatal("new job not handled")
+	}
+}
+
+func TestQueueDBClaimError(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return nil
+	}))
+	require.NoError(t, queue.AddJob("send_email", "first"))
+	require.NoError(t, queue.AddJob("send_email", "second"))
+
+	// claiming the second job fails after the first was claimed
+	updates := 0
+	err = db.Callback().Update().Before("gorm:update").Register("test:fail_claim", func(tx *gorm.DB) {
+		updates++
+		if updates == 2 {
+			_ = tx.AddError(errors.New("connection reset"))
+		}
+	})
+	require.NoError(t, err)
+	claimed, err := queue.claimJobs(DefaultQueueName, 2)
+	require.NoError(t, db.Callback().Update().Remove("test:fail_claim"))
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.Equal(t, "first", claimed[0].Payload)
+
+	queue.processJob(claimed[0])
+	var first job
+	require.NoError(t, db.First(&first, claimed[0].ID).Error)
+	require.Equal(t, statusComplete, first.Status)
+}
+
+func TestQueueDBRequeueStaleJobs(t *testing.T) {
+	db := openTestDB(t)
+	options := QueueDBOptions{
+		Queues:            []WorkerQueue{{Name: DefaultQueueName, Workers: 2, VisibilityTimeout: time.Millisecond * 100}},
+		HeartbeatInterval: time.Millisecond * 20,
+	}
+	setup := func(queue Queue, handled chan string) {
+		queue.SetJobOptions("charge", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+		queue.SetJobOptions("import", JobOptions{Retry: RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(0)}})
+		queue.AddJobContextHandler("charge", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			return nil
+		}))
+		queue.AddJobContextHandler("import", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			// outlives the visibility timeout, heartbeat keeps the lease
+			time.Sleep(time.Millisecond * 250)
+			handled <- job.Payload
+			return nil
+		}))
+	}
+
+	// crashed process claimed every job and never finished them
+	q, err := NewQueueDBWithOptions(db, options)
+	require.NoError(t, err)
+	crashed := q.(*queueDB)
+	setup(crashed, nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, crashed.AddJob("import", fmt.Sprint(i)))
+	}
+	chargeID, err := crashed.AddJobAt("charge", "order-1", time.Now())
+	require.NoError(t, err)
+	claimed, err := crashed.claimJobs(DefaultQueueName, 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 4)
+
+	q, err = NewQueueDBWithOptions(db, options)
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	handled := make(chan string, 10)
+	setup(queue, handled)
+
+	count, err := queue.requeueStaleJobs()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	time.Sleep(time.Millisecond * 150)
+	count, err = queue.requeueStaleJobs()
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	var failed job
+	require.NoError(t, db.First(&failed, chargeID).Error)
+	require.Equal(t, statusFailed, failed.Status)
+	require.Equal(t, ErrJobLeaseExpired.Error(), failed.LastError)
+	var attempts []jobAttempt
+	require.NoError(t, db.Where("error = ?", ErrJobLeaseExpired.Error()).Find(&attempts).Error)
+	require.Len(t, attempts, 4)
+
+	queue.Start()
+	defer queue.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 5):
+			t.Fatal("requeued jobs not handled")
+		}
+	}
+
+	// lease of the running jobs was extended, none of them was requeued again
+	var jobs []job
+	require.NoError(t, db.Where("job_name = ?", "import").Find(&jobs).Error)
+	require.Len(t, jobs, 3)
+	for _, j := range jobs {
+		require.Equal(t, 2, j.Attempts)
+	}
+}
+
+func TestQueueDBBackfillQueue(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.Exec(`CREATE TABLE jobs (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime,
+		updated_at datetime, deleted_at datetime, job_name text, payload text, status text, run_at datetime)`).Error)
+	require.NoError(t, db.Exec("INSERT INTO jobs (job_name, payload, status, run_at) VALUES (?, ?, ?, ?)",
+		"send_email", "old", statusWaiting, time.Now()).Error)
+
+	_, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	var j job
+	require.NoError(t, db.First(&j).Error)
+	require.Equal(t, DefaultQueueName, j.Queue)
+
+	// later constructions leave rows alone
+	require.NoError(t, db.Model(&job{}).Where("id = ?", j.ID).Update("queue", "").Error)
+	_, err = NewQueueDB(db, 1)
+	require.NoError(t, err)
+	require.NoError(t, db.First(&j).Error)
+	require.Equal(t, "", j.Queue)
+}
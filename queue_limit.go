@@ -0,0 +1,71 @@
+package gocommonweb
+
+import (
+	"time"
+)
+
+const (
+	// limitRetryDelay how long job deferred by concurrency limit waits before trying again
+	limitRetryDelay = time.Second
+
+	// limitLeaseDuration how long a concurrency slot of redis queue is held when
+	// the job has no timeout, slot of a crashed worker is freed after it expires
+	limitLeaseDuration = time.Hour
+)
+
+// JobLimit throttle executions of a job name across all workers sharing
+// the queue storage. job over the limit is deferred, it is not failed and
+// does not use up an attempt
+type JobLimit struct {
+	// Concurrency max jobs running at the same time, zero means unlimited
+	Concurrency int
+
+	// Rate max jobs started within Per window, zero means unlimited
+	Rate int
+	Per  time.Duration
+
+	// PartitionKey apply the limits separately per key taken from job payload,
+	// e.g. account id. nil means the limits apply to the job name as a whole
+	PartitionKey func(payload string) string
+}
+
+func (l JobLimit) enabled() bool {
+	return l.Concurrency > 0 || l.rateEnabled()
+}
+
+func (l JobLimit) rateEnabled() bool {
+	return l.Rate > 0 && l.Per > 0
+}
+
+// key identify the limit a job counts against
+func (l JobLimit) key(jobName string, payload string) string {
+	if l.PartitionKey == nil {
+		return jobName
+	}
+	return jobName + ":" + l.PartitionKey(payload)
+}
+
+// lease how long redis concurrency slot is held by a job
+func (l JobLimit) lease(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout + time.Minute
+	}
+	return limitLeaseDuration
+}
+
+// rateDelay time until the oldest start leaves the window, or zero when job may start
+func (l JobLimit) rateDelay(starts []time.Time, now time.Time) time.Duration {
+	if !l.rateEnabled() || len(starts) < l.Rate {
+		return 0
+	}
+	oldest := starts[0]
+	for _, start := range starts {
+		if start.Before(oldest) {
+			oldest = start
+		}
+	}
+	if delay := oldest.Add(l.Per).Sub(now); delay > 0 {
+		return delay
+	}
+	return limitRetryDelay
+}
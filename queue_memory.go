@@ -0,0 +1,900 @@
+package gocommonweb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// QueueMemoryOptions configuration of in memory queue
+type QueueMemoryOptions struct {
+	// Queues named queues and their worker count, default
+	// queue with one worker is used when it is empty
+	Queues []WorkerQueue
+
+	PriorityOrder PriorityOrder
+
+	// Sync run job handler inline inside AddJob and friends, delay, backoff
+	// and limits are ignored and failed attempts are retried right away.
+	// at most syncMaxAttempts are run inline, a job still failing after
+	// that is left waiting
+	Sync bool
+
+	// KeepCompleted number of completed and cancelled jobs kept for
+	// EnqueuedJobs and GetJobStatus, older ones are removed once twice
+	// as many are kept, default 1000. failed jobs are always kept
+	KeepCompleted int
+}
+
+const defaultKeepCompleted = 1000
+
+func (o QueueMemoryOptions) keepCompleted() int {
+	if o.KeepCompleted <= 0 {
+		return defaultKeepCompleted
+	}
+	return o.KeepCompleted
+}
+
+// syncMaxAttempts bound inline attempts of a job in sync mode so
+// a retry policy without attempt limit does not loop forever
+const syncMaxAttempts = 25
+
+// statusCancelled job removed by CancelJob, memory queue keeps it for EnqueuedJobs
+// like completed jobs
+const statusCancelled = "cancelled"
+
+type memoryJob struct {
+	Job
+	seq         int
+	queue       string
+	priority    int
+	status      string
+	runAt       time.Time
+	limited     bool
+	uniqueKey   string
+	uniqueFor   time.Duration
+	uniqueUntil time.Time
+	limitKey    string
+	lastError   string
+	failedAt    time.Time
+	history     []JobAttempt
+
+	progress        int
+	progressMessage string
+	result          string
+}
+
+// QueueMemory queue that keeps jobs in memory, it is meant for tests and
+// single process tools so it provides helpers to inspect enqueued jobs
+type QueueMemory struct {
+	jobMiddlewares
+	jobMetrics
+	jobStatusEvents
+	options QueueMemoryOptions
+	mutex   sync.Mutex
+	jobs    []*memoryJob
+	lastID  int
+
+	// waiting index of jobs with waiting status so picking a job does not
+	// scan finished ones, finished counts completed and cancelled jobs
+	waiting  map[*memoryJob]bool
+	finished int
+
+	handlers   map[string]JobContextHandler
+	jobOptions map[string]JobOptions
+	running    bool
+	closed     bool
+	inFlight   map[*memoryJob]bool
+
+	// limitRunning and limitStarts count running and recently
+	// started jobs per JobLimit key
+	limitRunning map[string]int
+	limitStarts  map[string][]time.Time
+
+	// changed is closed and replaced whenever jobs change to wake waiting workers
+	changed        chan struct{}
+	stopChan       chan struct{}
+	ctx            context.Context
+	cancel         context.CancelFunc
+	loopsWaitGroup sync.WaitGroup
+}
+
+// NewQueueMemory create in memory queue
+func NewQueueMemory(options QueueMemoryOptions) *QueueMemory {
+	if len(options.Queues) == 0 {
+		options.Queues = []WorkerQueue{{Name: DefaultQueueName, Workers: 1}}
+	}
+	for _, queue := range options.Queues {
+		if queue.Workers <= 0 {
+			panic(fmt.Errorf("queue %s job worker count must not be <= 0", queue.Name))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &QueueMemory{
+		options:      options,
+		handlers:     make(map[string]JobContextHandler),
+		jobOptions:   make(map[string]JobOptions),
+		inFlight:     make(map[*memoryJob]bool),
+		waiting:      make(map[*memoryJob]bool),
+		limitRunning: make(map[string]int),
+		limitStarts:  make(map[string][]time.Time),
+		changed:      make(chan struct{}),
+		stopChan:     make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func (q *QueueMemory) AddJob(jobName string, payload string) error {
+	return q.AddDelayedJob(jobName, payload, 0)
+}
+
+func (q *QueueMemory) AddDelayedJob(jobName string, payload string, delaySecs uint) error {
+	q.mutex.Lock()
+	j := q.newJob(jobName, payload, time.Now().Add(time.Second*time.Duration(delaySecs)))
+	q.notifyLocked()
+	q.mutex.Unlock()
+
+	q.runSync(j)
+	return nil
+}
+
+func (q *QueueMemory) AddJobAt(jobName string, payload string, runAt time.Time) (string, error) {
+	q.mutex.Lock()
+	j := q.newJob(jobName, payload, runAt)
+	q.notifyLocked()
+	q.mutex.Unlock()
+
+	q.runSync(j)
+	return j.ID, nil
+}
+
+func (q *QueueMemory) CancelJob(id string) error {
+	return q.updatePendingJob(id, func(j *memoryJob) {
+		q.setStatusLocked(j, statusCancelled)
+		q.pruneFinishedLocked()
+	})
+}
+
+func (q *QueueMemory) Reschedule(id string, runAt time.Time) error {
+	return q.updatePendingJob(id, func(j *memoryJob) {
+		j.runAt = runAt
+		j.limited = false
+		j.ScheduledAt = runAt
+	})
+}
+
+func (q *QueueMemory) updatePendingJob(id string, update func(j *memoryJob)) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for j := range q.waiting {
+		if j.ID == id {
+			update(j)
+			q.notifyLocked()
+			return nil
+		}
+	}
+	return ErrJobNotPending
+}
+
+func (q *QueueMemory) AddUniqueJob(jobName string, payload string, options UniqueOptions) (bool, error) {
+	key := uniqueJobKey(jobName, payload, options.Key)
+
+	q.mutex.Lock()
+	for _, existing := range q.jobs {
+		if existing.uniqueKey == key && existing.isBlockingDuplicate() {
+			q.mutex.Unlock()
+			return false, nil
+		}
+	}
+	j := q.newJob(jobName, payload, time.Now())
+	j.uniqueKey = key
+	j.uniqueFor = options.Window
+	q.notifyLocked()
+	q.mutex.Unlock()
+
+	q.runSync(j)
+	return true, nil
+}
+
+func (j *memoryJob) isBlockingDuplicate() bool {
+	if j.status == statusWaiting || j.status == statusProcessing {
+		return true
+	}
+	return j.status == statusComplete && j.uniqueUntil.After(time.Now())
+}
+
+func (q *QueueMemory) newJob(jobName string, payload string, runAt time.Time) *memoryJob {
+	options := q.jobOptions[jobName]
+	q.lastID++
+	j := &memoryJob{
+		seq: q.lastID,
+		Job: Job{
+			ID:          strconv.Itoa(q.lastID),
+			Name:        jobName,
+			Payload:     payload,
+			EnqueuedAt:  time.Now(),
+			ScheduledAt: runAt,
+		},
+		queue:    options.queueName(),
+		priority: options.priority(),
+		status:   statusWaiting,
+		runAt:    runAt,
+	}
+	q.jobs = append(q.jobs, j)
+	q.waiting[j] = true
+	return j
+}
+
+// setStatusLocked change job status keeping waiting index and finished count up to date
+func (q *QueueMemory) setStatusLocked(j *memoryJob, status string) {
+	if j.status == statusWaiting {
+		delete(q.waiting, j)
+	}
+	j.status = status
+	switch status {
+	case statusWaiting:
+		q.waiting[j] = true
+	case statusComplete, statusCancelled:
+		q.finished++
+	}
+}
+
+// pruneFinishedLocked remove oldest completed and cancelled jobs once there are
+// twice as many as kept so it runs only every so often, completed unique jobs
+// still blocking duplicates are not removed
+func (q *QueueMemory) pruneFinishedLocked() {
+	keep := q.options.keepCompleted()
+	if q.finished < keep*2 {
+		return
+	}
+
+	drop := q.finished - keep
+	now := time.Now()
+	jobs := q.jobs[:0]
+	for _, j := range q.jobs {
+		if drop > 0 && (j.status == statusComplete || j.status == statusCancelled) && !j.uniqueUntil.After(now) {
+			drop--
+			q.finished--
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	for i := len(jobs); i < len(q.jobs); i++ {
+		q.jobs[i] = nil
+	}
+	q.jobs = jobs
+}
+
+func (q *QueueMemory) AddJobHandler(jobName string, handler JobHandler) {
+	q.AddJobContextHandler(jobName, AdaptJobHandler(handler))
+}
+
+func (q *QueueMemory) AddJobContextHandler(jobName string, handler JobContextHandler) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.handlers[jobName] = handler
+	q.notifyLocked()
+}
+
+func (q *QueueMemory) SetJobOptions(jobName string, options JobOptions) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.jobOptions[jobName] = options
+}
+
+func (q *QueueMemory) Start() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.running || q.closed || q.options.Sync {
+		return
+	}
+	q.running = true
+	for _, queue := range q.options.Queues {
+		for i := 0; i < queue.Workers; i++ {
+			q.loopsWaitGroup.Add(1)
+			go q.startWorkerLoop(queue.Name)
+		}
+	}
+}
+
+func (q *QueueMemory) Close() {
+	_ = q.Shutdown(context.Background())
+}
+
+func (q *QueueMemory) Shutdown(ctx context.Context) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.running = false
+	close(q.stopChan)
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.loopsWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.cancel()
+	q.mutex.Lock()
+	for j := range q.inFlight {
+		q.setStatusLocked(j, statusWaiting)
+		j.Attempt--
+		delete(q.inFlight, j)
+		q.releaseLimitLocked(j)
+	}
+	q.notifyLocked()
+	q.mutex.Unlock()
+	return ctx.Err()
+}
+
+func (q *QueueMemory) startWorkerLoop(queueName string) {
+	defer q.loopsWaitGroup.Done()
+	for {
+		q.mutex.Lock()
+		j, nextRunAt := q.claimJobLocked(queueName)
+		changed := q.changed
+		q.mutex.Unlock()
+
+		if j != nil {
+			q.processJob(j)
+			continue
+		}
+
+		wait := time.Minute
+		if !nextRunAt.IsZero() {
+			wait = time.Until(nextRunAt)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-q.stopChan:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// claimJobLocked pick ready job of the queue, if there is none it returns
+// the earliest run time of waiting job so the worker knows how long to sleep
+func (q *QueueMemory) claimJobLocked(queueName string) (*memoryJob, time.Time) {
+	for {
+		j, nextRunAt := q.pickJobLocked(queueName)
+		if j == nil {
+			return nil, nextRunAt
+		}
+
+		limit := q.jobOptions[j.Name].Limit
+		j.limitKey = ""
+		if limit.enabled() {
+			j.limitKey = limit.key(j.Name, j.Payload)
+			if delay := q.limitDelayLocked(limit, j.limitKey); delay > 0 {
+				j.runAt = time.Now().Add(delay)
+				j.limited = true
+				continue
+			}
+			q.limitRunning[j.limitKey]++
+			q.limitStarts[j.limitKey] = append(q.limitStarts[j.limitKey], time.Now())
+		}
+
+		j.limited = false
+		q.setStatusLocked(j, statusProcessing)
+		j.Attempt++
+		q.inFlight[j] = true
+		return j, nextRunAt
+	}
+}
+
+// limitDelayLocked how long job with limitKey must wait to stay within limit
+func (q *QueueMemory) limitDelayLocked(limit JobLimit, limitKey string) time.Duration {
+	if limit.Concurrency > 0 && q.limitRunning[limitKey] >= limit.Concurrency {
+		return limitRetryDelay
+	}
+	if !limit.rateEnabled() {
+		return 0
+	}
+
+	now := time.Now()
+	var starts []time.Time
+	for _, start := range q.limitStarts[limitKey] {
+		if start.After(now.Add(-limit.Per)) {
+			starts = append(starts, start)
+		}
+	}
+	q.limitStarts[limitKey] = starts
+	return limit.rateDelay(starts, now)
+}
+
+func (q *QueueMemory) releaseLimitLocked(j *memoryJob) {
+	if j.limitKey != "" {
+		q.limitRunning[j.limitKey]--
+	}
+}
+
+// pickJobLocked ready job of the queue to run next
+func (q *QueueMemory) pickJobLocked(queueName string) (*memoryJob, time.Time) {
+	now := time.Now()
+	var ready []*memoryJob
+	var nextRunAt time.Time
+	for j := range q.waiting {
+		if j.queue != queueName {
+			continue
+		}
+		if _, ok := q.handlers[j.Name]; !ok {
+			continue
+		}
+		if j.runAt.After(now) {
+			if nextRunAt.IsZero() || j.runAt.Before(nextRunAt) {
+				nextRunAt = j.runAt
+			}
+			continue
+		}
+		ready = append(ready, j)
+	}
+	if len(ready) == 0 {
+		return nil, nextRunAt
+	}
+
+	if q.options.PriorityOrder == PriorityWeighted {
+		ready = pickWeightedMemoryJobs(ready)
+	}
+
+	var picked *memoryJob
+	for _, j := range ready {
+		if picked == nil || j.priority > picked.priority ||
+			(j.priority == picked.priority && j.runAt.Before(picked.runAt)) ||
+			(j.priority == picked.priority && j.runAt.Equal(picked.runAt) && j.seq < picked.seq) {
+			picked = j
+		}
+	}
+	return picked, nextRunAt
+}
+
+// pickWeightedMemoryJobs keep only jobs of one priority picked randomly weighted by its value
+func pickWeightedMemoryJobs(ready []*memoryJob) []*memoryJob {
+	weights := make(map[int]int)
+	total := 0
+	for _, j := range ready {
+		if _, ok := weights[j.priority]; !ok {
+			weights[j.priority] = j.priority
+			total += j.priority
+		}
+	}
+
+	pick := rand.Intn(total)
+	var priority int
+	for p, weight := range weights {
+		if pick < weight {
+			priority = p
+			break
+		}
+		pick -= weight
+	}
+
+	var picked []*memoryJob
+	for _, j := range ready {
+		if j.priority == priority {
+			picked = append(picked, j)
+		}
+	}
+	return picked
+}
+
+func (q *QueueMemory) processJob(j *memoryJob) {
+	q.mutex.Lock()
+	handler := q.handlers[j.Name]
+	options := q.jobOptions[j.Name]
+	descriptor := j.Job
+	descriptor.MaxAttempts = options.Retry.maxAttemptsDescriptor()
+	descriptor.progressReporter = func(pct int, message string) error {
+		q.updateProgress(j, pct, message)
+		return nil
+	}
+	dueAt := j.runAt
+	j.progress = 0
+	j.progressMessage = ""
+	startStatus := j.jobStatus()
+	q.mutex.Unlock()
+	q.publishStatus(startStatus)
+
+	startedAt := time.Now()
+	err := handleJobWithTimeout(q.ctx, q.wrap(handler), &descriptor, options)
+
+	q.mutex.Lock()
+	if !q.inFlight[j] {
+		// job already put back to the queue by Shutdown
+		q.mutex.Unlock()
+		return
+	}
+	q.recordAttempt(j.queue, j.Name, dueAt, startedAt, err)
+	q.finishJobLocked(j, options, descriptor.result, err, startedAt)
+	status := j.jobStatus()
+	q.mutex.Unlock()
+
+	// published outside of the lock as event handler may use the queue
+	q.publishStatus(status)
+}
+
+// finishJobLocked record attempt result, failed job is retried or marked as failed
+func (q *QueueMemory) finishJobLocked(j *memoryJob, options JobOptions, result string, err error, startedAt time.Time) {
+	delete(q.inFlight, j)
+	q.releaseLimitLocked(j)
+	defer q.notifyLocked()
+
+	if err == nil {
+		q.setStatusLocked(j, statusComplete)
+		j.result = result
+		if j.uniqueFor > 0 {
+			j.uniqueUntil = time.Now().Add(j.uniqueFor)
+		}
+		q.pruneFinishedLocked()
+		return
+	}
+
+	j.lastError = err.Error()
+	j.history = append(j.history, JobAttempt{
+		Attempt:    len(j.history) + 1,
+		Error:      err.Error(),
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	})
+	if options.Retry.shouldRetry(j.Attempt, err) {
+		q.setStatusLocked(j, statusWaiting)
+		if !q.options.Sync {
+			j.runAt = time.Now().Add(options.Retry.backoff(j.Attempt))
+		}
+	} else {
+		q.setStatusLocked(j, statusFailed)
+		j.failedAt = time.Now()
+		logrus.Debugf("[qmem] job %s - %s failed after %d attempts: %s", j.Name, j.ID, j.Attempt, err)
+	}
+}
+
+// runSync run the job inline including its retries when queue is in sync mode
+func (q *QueueMemory) runSync(j *memoryJob) {
+	if !q.options.Sync {
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		q.mutex.Lock()
+		_, hasHandler := q.handlers[j.Name]
+		if !hasHandler || j.status != statusWaiting {
+			q.mutex.Unlock()
+			return
+		}
+		if attempt == syncMaxAttempts {
+			q.mutex.Unlock()
+			logrus.Warnf("[qmem] job %s - %s still failing after %d inline attempts", j.Name, j.ID, attempt)
+			return
+		}
+		q.setStatusLocked(j, statusProcessing)
+		j.Attempt++
+		q.inFlight[j] = true
+		q.mutex.Unlock()
+
+		q.processJob(j)
+	}
+}
+
+// notifyLocked wake workers and Drain callers waiting for job changes
+func (q *QueueMemory) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Drain make delayed and backed off jobs due right away and wait until there is
+// no waiting or processing job left that has a handler. jobs deferred by their
+// JobLimit are not made due, Drain waits for the limit to allow them instead.
+// if the queue is not started the jobs are processed on the caller goroutine
+func (q *QueueMemory) Drain(timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		q.mutex.Lock()
+		pending := len(q.inFlight)
+		promoted := false
+		now := time.Now()
+		for j := range q.waiting {
+			if _, ok := q.handlers[j.Name]; !ok {
+				continue
+			}
+			if j.runAt.After(now) && !j.limited {
+				j.runAt = now
+				promoted = true
+			}
+			pending++
+		}
+		if promoted {
+			q.notifyLocked()
+		}
+		running := q.running
+		changed := q.changed
+		q.mutex.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		// started workers notify every job they finish, jobs deferred by
+		// limit are claimed by workers on their own timer
+		var nextRunAt time.Time
+		if !running {
+			processed, runAt, ok := q.processPendingInline(deadline.C)
+			if !ok {
+				return fmt.Errorf("queue still has pending jobs after %s", timeout)
+			}
+			if processed {
+				continue
+			}
+			nextRunAt = runAt
+		}
+
+		wake := time.NewTimer(time.Hour)
+		if !nextRunAt.IsZero() {
+			wake.Reset(time.Until(nextRunAt))
+		}
+		select {
+		case <-changed:
+		case <-wake.C:
+		case <-deadline.C:
+			wake.Stop()
+			return fmt.Errorf("queue still has %d pending jobs after %s", pending, timeout)
+		}
+		wake.Stop()
+	}
+}
+
+// processPendingInline process due jobs until there is none left, ok is false
+// when deadline expired first. when no job was processed the earliest run time
+// of jobs left waiting, deferred by their limit, tells caller how long to wait
+func (q *QueueMemory) processPendingInline(deadline <-chan time.Time) (processed bool, nextRunAt time.Time, ok bool) {
+	for _, queue := range q.options.Queues {
+		for {
+			select {
+			case <-deadline:
+				return processed, nextRunAt, false
+			default:
+			}
+
+			q.mutex.Lock()
+			j, runAt := q.claimJobLocked(queue.Name)
+			q.mutex.Unlock()
+			if j == nil {
+				if !runAt.IsZero() && (nextRunAt.IsZero() || runAt.Before(nextRunAt)) {
+					nextRunAt = runAt
+				}
+				break
+			}
+			q.processJob(j)
+			processed = true
+		}
+	}
+	return processed, nextRunAt, true
+}
+
+// EnqueuedJobs every job ever enqueued with jobName in enqueue order,
+// empty jobName returns jobs of all names
+func (q *QueueMemory) EnqueuedJobs(jobName string) []Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var jobs []Job
+	for _, j := range q.jobs {
+		if jobName == "" || j.Name == jobName {
+			jobs = append(jobs, j.Job)
+		}
+	}
+	return jobs
+}
+
+// PendingJobs jobs with jobName still waiting or processing
+func (q *QueueMemory) PendingJobs(jobName string) []Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var jobs []Job
+	for _, j := range q.jobs {
+		if (jobName == "" || j.Name == jobName) && (j.status == statusWaiting || j.status == statusProcessing) {
+			jobs = append(jobs, j.Job)
+		}
+	}
+	return jobs
+}
+
+// Stats count jobs still kept in memory per queue and job name
+func (q *QueueMemory) Stats() ([]JobStats, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	set := make(jobStatsSet)
+	for _, j := range q.jobs {
+		stats := set.get(j.queue, j.Name)
+		switch j.status {
+		case statusWaiting:
+			stats.Waiting++
+			if age := oldestWaiting(j.runAt, now); age > stats.OldestWaiting {
+				stats.OldestWaiting = age
+			}
+		case statusProcessing:
+			stats.Processing++
+		case statusFailed:
+			stats.Failed++
+		}
+	}
+	return q.mergeAttempts(set), nil
+}
+
+// GetJobStatus status of job kept in memory, cancelled jobs are not found
+func (q *QueueMemory) GetJobStatus(id string) (*JobStatus, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, j := range q.jobs {
+		if j.ID == id && j.status != statusCancelled {
+			status := j.jobStatus()
+			return &status, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
+
+func (q *QueueMemory) updateProgress(j *memoryJob, pct int, message string) {
+	q.mutex.Lock()
+	if j.status != statusProcessing {
+		q.mutex.Unlock()
+		return
+	}
+	j.progress = pct
+	j.progressMessage = message
+	status := j.jobStatus()
+	q.mutex.Unlock()
+	q.publishStatus(status)
+}
+
+func (j *memoryJob) jobStatus() JobStatus {
+	status := JobStatus{
+		ID:              j.ID,
+		Name:            j.Name,
+		Status:          j.status,
+		Attempt:         j.Attempt,
+		Progress:        j.progress,
+		ProgressMessage: j.progressMessage,
+		Result:          j.result,
+	}
+	if j.status != statusComplete {
+		status.Error = j.lastError
+	}
+	return status
+}
+
+// Reset forget all jobs
+func (q *QueueMemory) Reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.jobs = nil
+	q.waiting = make(map[*memoryJob]bool)
+	q.finished = 0
+	q.notifyLocked()
+}
+
+func (q *QueueMemory) FailedJobs(jobName string, offset int, limit int) ([]FailedJob, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var failedJobs []FailedJob
+	skipped := 0
+	for _, j := range q.jobs {
+		if j.status != statusFailed || (jobName != "" && j.Name != jobName) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if limit > 0 && len(failedJobs) >= limit {
+			break
+		}
+		failedJobs = append(failedJobs, FailedJob{
+			Job:      j.Job,
+			Error:    j.lastError,
+			FailedAt: j.failedAt,
+			History:  append([]JobAttempt(nil), j.history...),
+		})
+	}
+	return failedJobs, nil
+}
+
+func (q *QueueMemory) RetryFailedJob(id string) error {
+	count, err := q.updateFailedJobs(id, "", func(j *memoryJob) {
+		q.setStatusLocked(j, statusWaiting)
+		j.Attempt = 0
+		j.runAt = time.Now()
+	})
+	if err == nil && count == 0 {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return err
+}
+
+func (q *QueueMemory) RetryFailedJobs(jobName string) (int, error) {
+	return q.updateFailedJobs("", jobName, func(j *memoryJob) {
+		q.setStatusLocked(j, statusWaiting)
+		j.Attempt = 0
+		j.runAt = time.Now()
+	})
+}
+
+func (q *QueueMemory) DeleteFailedJob(id string) error {
+	count, err := q.deleteFailedJobs(id, "")
+	if err == nil && count == 0 {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return err
+}
+
+func (q *QueueMemory) DeleteFailedJobs(jobName string) (int, error) {
+	return q.deleteFailedJobs("", jobName)
+}
+
+func (q *QueueMemory) ExportFailedJobs(w io.Writer, jobName string) error {
+	return exportFailedJobs(w, func(offset int, limit int) ([]FailedJob, error) {
+		return q.FailedJobs(jobName, offset, limit)
+	})
+}
+
+func (q *QueueMemory) updateFailedJobs(id string, jobName string, update func(j *memoryJob)) (int, error) {
+	q.mutex.Lock()
+	var retried []*memoryJob
+	for _, j := range q.jobs {
+		if j.status == statusFailed && (id == "" || j.ID == id) && (jobName == "" || j.Name == jobName) {
+			update(j)
+			retried = append(retried, j)
+		}
+	}
+	q.notifyLocked()
+	q.mutex.Unlock()
+
+	for _, j := range retried {
+		q.runSync(j)
+	}
+	return len(retried), nil
+}
+
+func (q *QueueMemory) deleteFailedJobs(id string, jobName string) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	count := 0
+	jobs := q.jobs[:0]
+	for _, j := range q.jobs {
+		if j.status == statusFailed && (id == "" || j.ID == id) && (jobName == "" || j.Name == jobName) {
+			count++
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	q.jobs = jobs
+	return count, nil
+}
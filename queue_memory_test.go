@@ -0,0 +1,368 @@
+package gocommonweb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueMemorySync(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	defer queue.Close()
+
+	var handled []string
+	queue.SetJobOptions("flaky", JobOptions{Retry: RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(time.Hour)}})
+	queue.AddJobContextHandler("flaky", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Payload)
+		return errors.New("boom")
+	}))
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Payload)
+		return nil
+	}))
+
+	require.NoError(t, queue.AddJob("send_email", "a@example.com"))
+	require.NoError(t, queue.AddDelayedJob("send_email", "b@example.com", 3600))
+	require.Equal(t, []string{"a@example.com", "b@example.com"}, handled)
+	require.Len(t, queue.EnqueuedJobs("send_email"), 2)
+	require.Empty(t, queue.PendingJobs(""))
+
+	handled = nil
+	require.NoError(t, queue.AddJob("flaky", "x"))
+	require.Equal(t, []string{"x", "x", "x"}, handled)
+
+	failedJobs, err := queue.FailedJobs("flaky", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Len(t, failedJobs[0].History, 3)
+
+	count, err := queue.DeleteFailedJobs("")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestQueueMemoryDrainDeadline(t *testing.T) {
+	for _, syncMode := range []bool{true, false} {
+		queue := NewQueueMemory(QueueMemoryOptions{Sync: syncMode})
+		var attempts int32
+		queue.SetJobOptions("flaky", JobOptions{Retry: RetryPolicy{MaxAttempts: -1, Backoff: ConstantBackoff(time.Hour)}})
+		queue.AddJobContextHandler("flaky", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			atomic.AddInt32(&attempts, 1)
+			return errors.New("boom")
+		}))
+
+		// job retried forever is not run inline endlessly
+		require.NoError(t, queue.AddJob("flaky", "x"))
+		if syncMode {
+			require.Equal(t, int32(syncMaxAttempts), atomic.LoadInt32(&attempts))
+		}
+		require.Error(t, queue.Drain(time.Millisecond*50))
+		require.Len(t, queue.PendingJobs("flaky"), 1)
+		queue.Close()
+	}
+}
+
+func TestQueueMemoryWorkers(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{
+		Queues: []WorkerQueue{{Name: DefaultQueueName, Workers: 2}},
+	})
+	defer queue.Close()
+
+	var handled int32
+	queue.SetJobOptions("resize_image", JobOptions{
+		Retry: RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(time.Hour)},
+	})
+	queue.AddJobContextHandler("resize_image", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		if atomic.AddInt32(&handled, 1) == 1 {
+			return errors.New("first attempt fails")
+		}
+		return nil
+	}))
+	queue.Start()
+
+	require.NoError(t, queue.AddDelayedJob("resize_image", "1.png", 3600))
+	require.NoError(t, queue.AddJob("resize_image", "2.png"))
+
+	// delayed job and the backed off retry are made due by Drain
+	require.NoError(t, queue.Drain(time.Second*5))
+	require.Equal(t, int32(3), atomic.LoadInt32(&handled))
+	require.Empty(t, queue.PendingJobs("resize_image"))
+
+	enqueued, err := queue.AddUniqueJob("resize_image", "3.png", UniqueOptions{Window: time.Hour})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	require.NoError(t, queue.Drain(time.Second*5))
+
+	enqueued, err = queue.AddUniqueJob("resize_image", "3.png", UniqueOptions{Window: time.Hour})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+}
+
+func TestQueueMemoryJobLimit(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{
+		Queues: []WorkerQueue{{Name: DefaultQueueName, Workers: 4}},
+	})
+	defer queue.Close()
+
+	var running, maxRunning int32
+	queue.SetJobOptions("call_api", JobOptions{Limit: JobLimit{Concurrency: 2}})
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}))
+	queue.Start()
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, queue.AddJob("call_api", ""))
+	}
+	require.NoError(t, queue.Drain(time.Second*10))
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestQueueMemoryDrainRateLimit(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{})
+	defer queue.Close()
+
+	var handled []string
+	queue.SetJobOptions("call_api", JobOptions{Limit: JobLimit{Rate: 1, Per: time.Millisecond * 100}})
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Payload)
+		return nil
+	}))
+	for _, payload := range []string{"a", "b", "c"} {
+		require.NoError(t, queue.AddJob("call_api", payload))
+	}
+
+	// jobs deferred by the limit are waited for, not made due again
+	startedAt := time.Now()
+	require.NoError(t, queue.Drain(time.Second*5))
+	require.ElementsMatch(t, []string{"a", "b", "c"}, handled)
+	require.GreaterOrEqual(t, int64(time.Since(startedAt)), int64(time.Millisecond*200))
+
+	queue.SetJobOptions("call_slow_api", JobOptions{Limit: JobLimit{Rate: 1, Per: time.Hour}})
+	queue.AddJobContextHandler("call_slow_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Payload)
+		return nil
+	}))
+	require.NoError(t, queue.AddJob("call_slow_api", "d"))
+	require.NoError(t, queue.AddJob("call_slow_api", "e"))
+	require.Error(t, queue.Drain(time.Millisecond*50))
+	require.ElementsMatch(t, []string{"a", "b", "c", "d"}, handled)
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	require.Len(t, queue.waiting, 1)
+	for j := range queue.waiting {
+		require.True(t, j.limited)
+		require.True(t, j.runAt.After(time.Now().Add(time.Minute*30)))
+	}
+}
+
+func TestQueueMemoryKeepCompleted(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true, KeepCompleted: 2})
+	defer queue.Close()
+
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		if job.Payload == "bounce" {
+			return errors.New("boom")
+		}
+		return nil
+	}))
+
+	enqueued, err := queue.AddUniqueJob("send_email", "unique", UniqueOptions{Window: time.Hour})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	require.NoError(t, queue.AddJob("send_email", "bounce"))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, queue.AddJob("send_email", strconv.Itoa(i)))
+	}
+
+	// oldest completed jobs are removed, failed job and unique job
+	// still blocking duplicates are kept
+	var payloads []string
+	for _, job := range queue.EnqueuedJobs("send_email") {
+		payloads = append(payloads, job.Payload)
+	}
+	require.Equal(t, []string{"unique", "bounce", "4"}, payloads)
+
+	enqueued, err = queue.AddUniqueJob("send_email", "unique", UniqueOptions{Window: time.Hour})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+
+	failedJobs, err := queue.FailedJobs("send_email", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+}
+
+func TestQueueMemoryMiddleware(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	defer queue.Close()
+
+	var calls []string
+	queue.Use(func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			calls = append(calls, "outer")
+			return next.HandleJob(ctx, job)
+		})
+	}, MetricsJobMiddleware(func(job *Job, duration time.Duration, err error) {
+		calls = append(calls, "observed "+job.Name)
+	}))
+
+	queue.SetJobOptions("explode", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("explode", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		panic("boom")
+	}))
+	require.NoError(t, queue.AddJob("explode", ""))
+	require.Equal(t, []string{"outer", "observed explode"}, calls)
+
+	failedJobs, err := queue.FailedJobs("explode", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Contains(t, failedJobs[0].Error, "job panic: boom")
+}
+
+type recordedJobHandler struct {
+	calls []string
+}
+
+func (h *recordedJobHandler) Handle(jobName string, payload string) error {
+	h.calls = append(h.calls, jobName+":"+payload)
+	return nil
+}
+
+func TestQueueMemoryLegacyJobHandler(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	defer queue.Close()
+
+	var seen []Job
+	queue.Use(func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			seen = append(seen, *job)
+			return next.HandleJob(ctx, job)
+		})
+	})
+
+	handler := &recordedJobHandler{}
+	queue.AddJobHandler("send_email", handler)
+	queue.AddJobContextHandler("resize_image", AdaptJobHandler(handler))
+
+	id, err := queue.AddJobAt("send_email", "a@example.com", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, queue.AddJob("resize_image", "avatar.png"))
+	require.Equal(t, []string{"send_email:a@example.com", "resize_image:avatar.png"}, handler.calls)
+
+	// descriptor given to the adapter is filled in by the queue
+	require.Len(t, seen, 2)
+	require.Equal(t, id, seen[0].ID)
+	require.Equal(t, "send_email", seen[0].Name)
+	require.Equal(t, "a@example.com", seen[0].Payload)
+	require.Equal(t, 1, seen[0].Attempt)
+	require.NotEmpty(t, seen[1].ID)
+	require.NotEqual(t, id, seen[1].ID)
+	require.Equal(t, "resize_image", seen[1].Name)
+	require.Equal(t, 1, seen[1].Attempt)
+}
+
+type recordedEvents struct {
+	payloads []string
+}
+
+func (e *recordedEvents) Publish(eventName string, payload string) error {
+	e.payloads = append(e.payloads, payload)
+	return nil
+}
+
+func (e *recordedEvents) Subscribe(eventName string, handler EventHandler) error { return nil }
+
+func (e *recordedEvents) Unsubscribe(eventName string) {}
+
+func TestQueueMemoryJobStatus(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	defer queue.Close()
+
+	events := &recordedEvents{}
+	queue.PublishJobStatus(events, "job_status")
+	queue.AddJobContextHandler("import_csv", JobResultHandlerFunc(func(ctx context.Context, job *Job) (string, error) {
+		require.NoError(t, job.ReportProgress(50, "halfway"))
+		return `{"rows":10}`, nil
+	}))
+
+	id, err := queue.AddJobAt("import_csv", "users.csv", time.Now())
+	require.NoError(t, err)
+
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobComplete, status.Status)
+	require.Equal(t, 50, status.Progress)
+	require.Equal(t, "halfway", status.ProgressMessage)
+	require.Equal(t, `{"rows":10}`, status.Result)
+
+	require.Len(t, events.payloads, 3)
+	require.Contains(t, events.payloads[0], `"status":"processing"`)
+	require.Contains(t, events.payloads[1], `"progress":50`)
+	require.Contains(t, events.payloads[2], `"status":"complete"`)
+
+	_, err = queue.GetJobStatus("unknown")
+	require.Equal(t, ErrJobNotFound, err)
+}
+
+func TestQueueMemoryTimedOutHandler(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	defer queue.Close()
+
+	release := make(chan bool)
+	reported := make(chan error, 1)
+	queue.SetJobOptions("stuck", JobOptions{
+		Timeout:      time.Millisecond * 20,
+		TimeoutGrace: time.Millisecond * 20,
+		Retry:        RetryPolicy{MaxAttempts: 1},
+	})
+	queue.AddJobContextHandler("stuck", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		// ignores cancellation on purpose
+		<-release
+		job.SetResult("late")
+		reported <- job.ReportProgress(100, "done")
+		return nil
+	}))
+
+	id, err := queue.AddJobAt("stuck", "", time.Now())
+	require.NoError(t, err)
+	close(release)
+	require.Error(t, <-reported)
+
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobFailed, status.Status)
+	require.Zero(t, status.Progress)
+	require.Empty(t, status.Result)
+
+	// handler that returns once its context is done is waited for
+	var returned int32
+	queue.SetJobOptions("slow", JobOptions{Timeout: time.Millisecond * 20, Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("slow", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 20)
+		atomic.StoreInt32(&returned, 1)
+		return ctx.Err()
+	}))
+	id, err = queue.AddJobAt("slow", "", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&returned))
+	status, err = queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobFailed, status.Status)
+	require.Contains(t, status.Error, ErrJobTimeout.Error())
+}
@@ -0,0 +1,120 @@
+package gocommonweb
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JobMiddleware wrap job handler to run code around every job attempt
+type JobMiddleware func(next JobContextHandler) JobContextHandler
+
+// JobPanicError attempt error of handler that panicked
+type JobPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *JobPanicError) Error() string {
+	return fmt.Sprintf("job panic: %v\n%s", e.Value, e.Stack)
+}
+
+// jobMiddlewares middleware chain shared by queue implementations
+type jobMiddlewares struct {
+	middlewareMutex sync.Mutex
+	middlewares     []JobMiddleware
+}
+
+// Use add middleware to the chain, the first added middleware is the outermost
+func (m *jobMiddlewares) Use(middleware ...JobMiddleware) {
+	m.middlewareMutex.Lock()
+	defer m.middlewareMutex.Unlock()
+	m.middlewares = append(m.middlewares, middleware...)
+}
+
+// wrap handler with the middleware chain, panic of handler is recovered
+// inside the chain so middlewares see it as error, panic of a middleware
+// is recovered outside of it. both are turned into failed attempt
+func (m *jobMiddlewares) wrap(handler JobContextHandler) JobContextHandler {
+	m.middlewareMutex.Lock()
+	defer m.middlewareMutex.Unlock()
+	if len(m.middlewares) == 0 {
+		return recoverJobHandler(handler)
+	}
+
+	handler = recoverJobHandler(handler)
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		handler = m.middlewares[i](handler)
+	}
+	return recoverJobHandler(handler)
+}
+
+func recoverJobHandler(next JobContextHandler) JobContextHandler {
+	return JobContextHandlerFunc(func(ctx context.Context, job *Job) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &JobPanicError{Value: r, Stack: debug.Stack()}
+				logrus.Errorf("[queue] job %s - %s panic: %v", job.Name, job.ID, r)
+			}
+		}()
+		return next.HandleJob(ctx, job)
+	})
+}
+
+// LoggingJobMiddleware log every attempt with job id, name, attempt and duration
+func LoggingJobMiddleware(logger logrus.FieldLogger) JobMiddleware {
+	return func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			startedAt := time.Now()
+			err := next.HandleJob(ctx, job)
+
+			entry := logger.WithFields(logrus.Fields{
+				"job_id":   job.ID,
+				"job_name": job.Name,
+				"attempt":  job.Attempt,
+				"duration": time.Since(startedAt),
+			})
+			if err != nil {
+				entry.WithError(err).Warn("job attempt failed")
+			} else {
+				entry.Info("job attempt completed")
+			}
+			return err
+		})
+	}
+}
+
+// JobObserver receive result of every attempt e.g. to record metrics
+type JobObserver func(job *Job, duration time.Duration, err error)
+
+// MetricsJobMiddleware report duration and result of every attempt to observe
+func MetricsJobMiddleware(observe JobObserver) JobMiddleware {
+	return func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			startedAt := time.Now()
+			err := next.HandleJob(ctx, job)
+			observe(job, time.Since(startedAt), err)
+			return err
+		})
+	}
+}
+
+// JobTracer start a span for the attempt, returned context is passed to the
+// handler and finish is called with the attempt result
+type JobTracer func(ctx context.Context, job *Job) (spanCtx context.Context, finish func(err error))
+
+// TracingJobMiddleware run every attempt within a span started by tracer
+func TracingJobMiddleware(tracer JobTracer) JobMiddleware {
+	return func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			spanCtx, finish := tracer(ctx, job)
+			err := next.HandleJob(spanCtx, job)
+			finish(err)
+			return err
+		})
+	}
+}
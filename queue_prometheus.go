@@ -0,0 +1,79 @@
+package gocommonweb
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queueCollector prometheus collector reading queue Stats on every scrape
+type queueCollector struct {
+	queue    Queue
+	jobs     *prometheus.Desc
+	oldest   *prometheus.Desc
+	attempts *prometheus.Desc
+	latency  *prometheus.Desc
+	duration *prometheus.Desc
+}
+
+// NewQueueCollector create prometheus collector of queue stats, metric names
+// are prefixed by namespace e.g. myapp_queue_jobs. register it once per process
+//
+//	prometheus.MustRegister(gocommonweb.NewQueueCollector(queue, "myapp"))
+func NewQueueCollector(queue Queue, namespace string) prometheus.Collector {
+	labels := []string{"queue", "job_name"}
+	return &queueCollector{
+		queue: queue,
+		jobs: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", "jobs"),
+			"Number of jobs by state.",
+			append(labels, "state"), nil,
+		),
+		oldest: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", "oldest_waiting_seconds"),
+			"Age of the oldest job due to run.",
+			labels, nil,
+		),
+		attempts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", "attempts_total"),
+			"Job attempts handled by this process by result.",
+			append(labels, "result"), nil,
+		),
+		latency: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", "latency_seconds"),
+			"Time from a job being due to its attempt start.",
+			labels, nil,
+		),
+		duration: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "queue", "duration_seconds"),
+			"Run duration of job attempts.",
+			labels, nil,
+		),
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.jobs
+	ch <- c.oldest
+	ch <- c.attempts
+	ch <- c.latency
+	ch <- c.duration
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.queue.Stats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.jobs, err)
+		return
+	}
+
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(s.Waiting), s.Queue, s.JobName, statusWaiting)
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(s.Processing), s.Queue, s.JobName, statusProcessing)
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(s.Failed), s.Queue, s.JobName, statusFailed)
+		ch <- prometheus.MustNewConstMetric(c.oldest, prometheus.GaugeValue, s.OldestWaiting.Seconds(), s.Queue, s.JobName)
+
+		ch <- prometheus.MustNewConstMetric(c.attempts, prometheus.CounterValue, float64(s.Succeeded), s.Queue, s.JobName, "succeeded")
+		ch <- prometheus.MustNewConstMetric(c.attempts, prometheus.CounterValue, float64(s.FailedAttempts), s.Queue, s.JobName, "failed")
+		ch <- prometheus.MustNewConstSummary(c.latency, uint64(s.Attempts()), s.LatencyTotal.Seconds(), nil, s.Queue, s.JobName)
+		ch <- prometheus.MustNewConstSummary(c.duration, uint64(s.Attempts()), s.DurationTotal.Seconds(), nil, s.Queue, s.JobName)
+	}
+}
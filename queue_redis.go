@@ -1,67 +1,1080 @@
 package gocommonweb
 
 import (
-	"github.com/gocraft/work"
-	"github.com/gomodule/redigo/redis"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 )
 
-type queueImpl struct {
-	enqueuer *work.Enqueuer
-	worker   *work.WorkerPool
+// redis queue key layout, all keys are prefixed with "<namespace>:queue:"
+//
+//	job:<id>        hash of job fields
+//	ready:<name>    list of ids ready to run, pushed left and popped right
+//	scheduled       zset of delayed and backed off job ids scored by run time
+//	processing      zset of claimed job ids scored by lease expiry
+//	failed          zset of failed job ids scored by fail time
+//	known_jobs      set of every enqueued job name
+//	unique:<key>    id of job holding the uniqueness key
+//	limit:<key>:*   JobLimit running slots and starts
+
+const (
+	defaultRedisNamespace    = "gocommonweb"
+	defaultRedisWorkers      = 5
+	defaultRedisPollInterval = time.Second
+
+	// redisJobLease claimed job goes back to the queue when its worker
+	// stops renewing the lease, e.g. because the process crashed
+	redisJobLease = time.Minute
+
+	// redisMoveBatchSize due jobs moved to their ready list and
+	// expired leases failed per batch
+	redisMoveBatchSize = 100
+
+	defaultRedisResultTTL = time.Hour * 24
+
+	defaultRedisStatsCacheTTL = time.Second * 10
+)
+
+// QueueRedisOptions configuration of redis queue
+type QueueRedisOptions struct {
+	// Client the same client cache and event use, *redis.Client,
+	// *redis.ClusterClient or any other redis.UniversalClient
+	Client redis.UniversalClient
+
+	// Namespace prefix of queue keys, usually app name. on redis cluster wrap
+	// it in braces e.g. "{myapp}" so all queue keys are in the same slot
+	Namespace string
+
+	// Queues named queues and their worker count, default
+	// queue with 5 workers is used when it is empty
+	Queues []WorkerQueue
+
+	PriorityOrder PriorityOrder
+
+	// PollInterval how often idle workers look for jobs and due jobs
+	// are moved to their ready list, default 1 second
+	PollInterval time.Duration
+
+	// ResultTTL how long hash of completed job is kept for GetJobStatus, default 24 hours
+	ResultTTL time.Duration
+
+	// StatsCacheTTL how long job counts of Stats are reused, default 10 seconds.
+	// counting scans scheduled, processing and failed sets so it costs a
+	// redis round trip per 100 jobs in them
+	StatsCacheTTL time.Duration
 }
 
-type contextSample struct{}
+type queueRedis struct {
+	jobMiddlewares
+	jobMetrics
+	jobStatusEvents
+	rds            redis.UniversalClient
+	ownsClient     bool
+	prefix         string
+	options        QueueRedisOptions
+	handlers       map[string]JobContextHandler
+	jobOptions     map[string]JobOptions
+	handlerMutex   sync.Mutex
+	running        bool
+	closed         bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	stopChan       chan struct{}
+	loopsWaitGroup sync.WaitGroup
+	inFlight       map[string]string
+	abandoned      bool
+	inFlightMutex  sync.Mutex
+	lostCallbacks  map[string]func(job *Job, err error)
+	statsCache     []JobStats
+	statsCachedAt  time.Time
+	statsMutex     sync.Mutex
+}
 
-// NewQueueRedis create new queue backed by redis
+// NewQueueRedis create new queue backed by redis with 5 workers for the default queue.
+// breaking change: jobs are kept under <appName>:queue:* keys instead of the gocraft/work
+// layout used before, jobs enqueued by the old version are not run until moved with
+// MigrateGocraftJobs
 func NewQueueRedis(
 	appName string,
 	redisAddress string,
 	redisPassword string) Queue {
+	return NewQueueRedisWithQueues(appName, redisAddress, redisPassword, WorkerQueue{Name: DefaultQueueName, Workers: defaultRedisWorkers})
+}
+
+// NewQueueRedisWithQueues create new queue backed by redis connecting to redisAddress,
+// the connection is closed together with the queue
+func NewQueueRedisWithQueues(
+	appName string,
+	redisAddress string,
+	redisPassword string,
+	queues ...WorkerQueue) Queue {
+
+	if len(queues) == 0 {
+		panic(fmt.Errorf("queue must have at least one worker queue"))
+	}
+
+	q := newQueueRedis(QueueRedisOptions{
+		Client:    redis.NewClient(&redis.Options{Addr: redisAddress, Password: redisPassword}),
+		Namespace: appName,
+		Queues:    queues,
+	})
+	q.ownsClient = true
+	return q
+}
 
-	// Make a redis pool
-	var redisPool = &redis.Pool{
-		MaxActive: 5,
-		MaxIdle:   5,
-		Wait:      true,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisAddress, redis.DialPassword(redisPassword))
-		},
+// NewQueueRedisWithOptions create new queue backed by redis using options.Client,
+// the client is left open when the queue is closed
+func NewQueueRedisWithOptions(options QueueRedisOptions) Queue {
+	return newQueueRedis(options)
+}
+
+func newQueueRedis(options QueueRedisOptions) *queueRedis {
+	if options.Client == nil {
+		panic(fmt.Errorf("redis queue requires a redis client"))
+	}
+	if options.Namespace == "" {
+		options.Namespace = defaultRedisNamespace
+	}
+	if len(options.Queues) == 0 {
+		options.Queues = []WorkerQueue{{Name: DefaultQueueName, Workers: defaultRedisWorkers}}
+	}
+	for _, queue := range options.Queues {
+		if queue.Workers <= 0 {
+			panic(fmt.Errorf("queue %s job worker count must not be <= 0", queue.Name))
+		}
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultRedisPollInterval
+	}
+	if options.ResultTTL <= 0 {
+		options.ResultTTL = defaultRedisResultTTL
+	}
+	if options.StatsCacheTTL <= 0 {
+		options.StatsCacheTTL = defaultRedisStatsCacheTTL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &queueRedis{
+		rds:        options.Client,
+		prefix:     redisNamespacePrefix(options.Namespace) + "queue:",
+		options:    options,
+		handlers:   make(map[string]JobContextHandler),
+		jobOptions: make(map[string]JobOptions),
+		ctx:        ctx,
+		cancel:     cancel,
+		stopChan:   make(chan struct{}),
+		inFlight:   make(map[string]string),
+
+		lostCallbacks: make(map[string]func(job *Job, err error)),
+	}
+}
+
+func redisNamespacePrefix(namespace string) string {
+	if l := len(namespace); l > 0 && namespace[l-1] != ':' {
+		return namespace + ":"
+	}
+	return namespace
+}
+
+func (q *queueRedis) jobKey(id string) string        { return q.prefix + "job:" + id }
+func (q *queueRedis) readyKey(jobName string) string { return q.prefix + "ready:" + jobName }
+func (q *queueRedis) scheduledKey() string           { return q.prefix + "scheduled" }
+func (q *queueRedis) processingKey() string          { return q.prefix + "processing" }
+func (q *queueRedis) failedKey() string              { return q.prefix + "failed" }
+func (q *queueRedis) uniqueKey(key string) string    { return q.prefix + "unique:" + key }
+func (q *queueRedis) knownJobsKey() string           { return q.prefix + "known_jobs" }
+
+// redisJob job as stored in its redis hash, times are unix milliseconds
+type redisJob struct {
+	ID          string
+	Name        string
+	Payload     string
+	Attempts    int
+	EnqueuedAt  time.Time
+	ScheduledAt time.Time
+	UniqueKey   string
+	UniqueFor   time.Duration
+	LastError   string
+	History     []JobAttempt
+	FailedAt    time.Time
+	StartedAt   time.Time
+
+	Progress        int
+	ProgressMessage string
+	Result          string
+	CompletedAt     time.Time
+}
+
+func parseRedisJob(id string, values map[string]string) (*redisJob, bool) {
+	if values["name"] == "" {
+		return nil, false
 	}
 
-	enqueuer := work.NewEnqueuer(appName, redisPool)
-	pool := work.NewWorkerPool(contextSample{}, 5, appName, redisPool)
+	j := &redisJob{
+		ID:        id,
+		Name:      values["name"],
+		Payload:   values["payload"],
+		UniqueKey: values["unique_key"],
+		LastError: values["last_error"],
 
-	return &queueImpl{
-		enqueuer: enqueuer,
-		worker:   pool,
+		ProgressMessage: values["progress_message"],
+		Result:          values["result"],
 	}
+	j.Attempts, _ = strconv.Atoi(values["attempts"])
+	j.Progress, _ = strconv.Atoi(values["progress"])
+	j.CompletedAt = parseUnixMilli(values["completed_at"])
+	j.EnqueuedAt = parseUnixMilli(values["enqueued_at"])
+	j.ScheduledAt = parseUnixMilli(values["scheduled_at"])
+	j.FailedAt = parseUnixMilli(values["failed_at"])
+	j.StartedAt = parseUnixMilli(values["started_at"])
+	uniqueFor, _ := strconv.ParseInt(values["unique_for"], 10, 64)
+	j.UniqueFor = time.Duration(uniqueFor)
+	if history := values["history"]; history != "" {
+		_ = json.Unmarshal([]byte(history), &j.History)
+	}
+	return j, true
 }
 
-func (q *queueImpl) AddJob(jobName string, payload string) error {
-	_, err := q.enqueuer.Enqueue(jobName, work.Q{"payload": payload})
+func (j *redisJob) descriptor() *Job {
+	return &Job{
+		ID:          j.ID,
+		Name:        j.Name,
+		Payload:     j.Payload,
+		Attempt:     j.Attempts,
+		EnqueuedAt:  j.EnqueuedAt,
+		ScheduledAt: j.ScheduledAt,
+	}
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func parseUnixMilli(value string) time.Time {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func newRedisJobID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (q *queueRedis) AddJob(jobName string, payload string) error {
+	_, err := q.enqueue(newRedisJobID(), jobName, payload, time.Now(), nil)
 	return err
 }
 
-func (q *queueImpl) AddDelayedJob(jobName string, payload string, delaySecs uint) error {
-	_, err := q.enqueuer.EnqueueIn(jobName, int64(delaySecs), work.Q{"payload": payload})
+func (q *queueRedis) AddDelayedJob(jobName string, payload string, delaySecs uint) error {
+	_, err := q.enqueue(newRedisJobID(), jobName, payload, time.Now().Add(time.Second*time.Duration(delaySecs)), nil)
 	return err
 }
 
-func (q *queueImpl) AddJobHandler(jobName string, handler JobHandler) {
-	q.worker.Job(jobName, func(job *work.Job) error {
-		payload := job.ArgString("payload")
-		return handler.Handle(job.Name, payload)
+// AddUniqueJob take the unique key first, it is held until the job
+// completes and kept for the uniqueness window after that
+func (q *queueRedis) AddUniqueJob(jobName string, payload string, options UniqueOptions) (bool, error) {
+	key := uniqueJobKey(jobName, payload, options.Key)
+	id := newRedisJobID()
+
+	ok, err := q.takeUniqueKey(context.Background(), key, id)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	_, err = q.enqueue(id, jobName, payload, time.Now(), map[string]interface{}{
+		"unique_key": key,
+		"unique_for": int64(options.Window),
+	})
+	if err != nil {
+		q.rds.Del(context.Background(), q.uniqueKey(key))
+		return false, err
+	}
+	return true, nil
+}
+
+func (q *queueRedis) enqueue(id string, jobName string, payload string, runAt time.Time, extra map[string]interface{}) (string, error) {
+	ctx := context.Background()
+	fields := map[string]interface{}{
+		"name":         jobName,
+		"payload":      payload,
+		"attempts":     0,
+		"enqueued_at":  unixMilli(time.Now()),
+		"scheduled_at": unixMilli(runAt),
+	}
+	for field, value := range extra {
+		fields[field] = value
+	}
+
+	_, err := q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.jobKey(id), fields)
+		pipe.SAdd(ctx, q.knownJobsKey(), jobName)
+		if runAt.After(time.Now()) {
+			pipe.ZAdd(ctx, q.scheduledKey(), &redis.Z{Score: float64(unixMilli(runAt)), Member: id})
+		} else {
+			pipe.LPush(ctx, q.readyKey(jobName), id)
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (q *queueRedis) AddJobHandler(jobName string, handler JobHandler) {
+	q.AddJobContextHandler(jobName, AdaptJobHandler(handler))
+}
+
+func (q *queueRedis) AddJobContextHandler(jobName string, handler JobContextHandler) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	q.handlers[jobName] = handler
+}
+
+func (q *queueRedis) SetJobOptions(jobName string, options JobOptions) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	q.jobOptions[jobName] = options
+}
+
+func (q *queueRedis) onJobLost(jobName string, callback func(job *Job, err error)) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	q.lostCallbacks[jobName] = callback
+}
+
+func (q *queueRedis) getHandler(jobName string) (JobContextHandler, JobOptions, bool) {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	handler, ok := q.handlers[jobName]
+	return handler, q.jobOptions[jobName], ok
+}
+
+// orderedJobNames job names of the queue this process handles in the order
+// their ready lists are checked, highest priority first or weighted random
+func (q *queueRedis) orderedJobNames(queueName string) []string {
+	q.handlerMutex.Lock()
+	var jobNames []string
+	priorities := make(map[string]int)
+	for jobName := range q.handlers {
+		options := q.jobOptions[jobName]
+		if options.queueName() == queueName {
+			jobNames = append(jobNames, jobName)
+			priorities[jobName] = options.priority()
+		}
+	}
+	q.handlerMutex.Unlock()
+
+	if q.options.PriorityOrder != PriorityWeighted {
+		sort.SliceStable(jobNames, func(i, j int) bool {
+			return priorities[jobNames[i]] > priorities[jobNames[j]]
+		})
+		return jobNames
+	}
+
+	ordered := make([]string, 0, len(jobNames))
+	for len(jobNames) > 0 {
+		total := 0
+		for _, jobName := range jobNames {
+			total += priorities[jobName]
+		}
+		pick := mathrand.Intn(total)
+		for i, jobName := range jobNames {
+			if pick < priorities[jobName] {
+				ordered = append(ordered, jobName)
+				jobNames = append(jobNames[:i], jobNames[i+1:]...)
+				break
+			}
+			pick -= priorities[jobName]
+		}
+	}
+	return ordered
+}
+
+func (q *queueRedis) Start() {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	if q.running || q.closed {
+		return
+	}
+	q.running = true
+	for _, queue := range q.options.Queues {
+		for i := 0; i < queue.Workers; i++ {
+			q.loopsWaitGroup.Add(1)
+			go q.startWorkerLoop(queue.Name)
+		}
+	}
+	q.loopsWaitGroup.Add(1)
+	go q.startMoveLoop()
+	logrus.Info("[qredis] worker and scheduler running...")
+}
+
+func (q *queueRedis) Close() {
+	_ = q.Shutdown(context.Background())
+}
+
+func (q *queueRedis) Shutdown(ctx context.Context) error {
+	q.handlerMutex.Lock()
+	if q.closed {
+		q.handlerMutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	wasRunning := q.running
+	q.running = false
+	close(q.stopChan)
+	q.handlerMutex.Unlock()
+
+	defer q.closeClient()
+	if !wasRunning {
+		q.cancel()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.loopsWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		logrus.Info("[qredis] queue shutdown gracefully")
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.cancel()
+	q.inFlightMutex.Lock()
+	q.abandoned = true
+	inFlight := q.inFlight
+	q.inFlight = make(map[string]string)
+	q.inFlightMutex.Unlock()
+
+	if len(inFlight) > 0 {
+		bg := context.Background()
+		_, err := q.rds.TxPipelined(bg, func(pipe redis.Pipeliner) error {
+			for id, jobName := range inFlight {
+				q.requeueJob(bg, pipe, id, jobName)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logrus.Infof("[qredis] %d unfinished jobs put back to queue", len(inFlight))
+	}
+	return ctx.Err()
+}
+
+func (q *queueRedis) closeClient() {
+	if !q.ownsClient {
+		return
+	}
+	if err := q.rds.Close(); err != nil {
+		logrus.Errorf("err closing queue redis client: %s", err)
+	}
+}
+
+// requeueJob put claimed job back to the front of its ready list as it was before the attempt
+func (q *queueRedis) requeueJob(ctx context.Context, pipe redis.Pipeliner, id string, jobName string) {
+	pipe.ZRem(ctx, q.processingKey(), id)
+	pipe.HIncrBy(ctx, q.jobKey(id), "attempts", -1)
+	pipe.RPush(ctx, q.readyKey(jobName), id)
+}
+
+func (q *queueRedis) startWorkerLoop(queueName string) {
+	defer q.loopsWaitGroup.Done()
+	for {
+		select {
+		case <-q.stopChan:
+			logrus.Info("[qredis] worker loop stopped")
+			return
+		default:
+		}
+
+		if q.processNextJob(queueName) {
+			continue
+		}
+
+		timer := time.NewTimer(q.options.PollInterval)
+		select {
+		case <-timer.C:
+		case <-q.stopChan:
+			timer.Stop()
+			logrus.Info("[qredis] worker loop stopped")
+			return
+		}
+	}
+}
+
+// claimJobScript pop job id from ready list and mark it processing until lease
+// expires, progress of the previous attempt is cleared. it returns 0 without
+// claiming when the id is no longer at the end of the ready list
+//
+// KEYS[1] ready list, KEYS[2] processing zset, KEYS[3] job hash
+// ARGV lease expiry ms, job id, now ms
+var claimJobScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], -1) ~= ARGV[2] then
+	return 0
+end
+redis.call('RPOP', KEYS[1])
+redis.call('ZADD', KEYS[2], ARGV[1], ARGV[2])
+redis.call('HINCRBY', KEYS[3], 'attempts', 1)
+redis.call('HSET', KEYS[3], 'started_at', ARGV[3])
+redis.call('HDEL', KEYS[3], 'progress', 'progress_message')
+return 1
+`)
+
+// claimJob claim the oldest ready job, the id is read first so every key the
+// script touches is declared. it returns redis.Nil when the list is empty
+func (q *queueRedis) claimJob(ctx context.Context, jobName string) (string, error) {
+	for {
+		id, err := q.rds.LIndex(ctx, q.readyKey(jobName), -1).Result()
+		if err != nil {
+			return "", err
+		}
+		now := time.Now()
+		claimed, err := claimJobScript.Run(ctx, q.rds,
+			[]string{q.readyKey(jobName), q.processingKey(), q.jobKey(id)},
+			unixMilli(now.Add(redisJobLease)), id, unixMilli(now),
+		).Int()
+		if err != nil {
+			return "", err
+		}
+		if claimed == 1 {
+			return id, nil
+		}
+		// another worker claimed it first
+	}
+}
+
+// processNextJob claim and run one job of the queue, it returns false when there is none
+func (q *queueRedis) processNextJob(queueName string) bool {
+	ctx := context.Background()
+	for _, jobName := range q.orderedJobNames(queueName) {
+		id, err := q.claimJob(ctx, jobName)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("[qredis] claim job %s: %s", jobName, err)
+			return false
+		}
+
+		values, err := q.rds.HGetAll(ctx, q.jobKey(id)).Result()
+		if err != nil {
+			logrus.Errorf("[qredis] load job %s: %s", id, err)
+			return false
+		}
+		j, ok := parseRedisJob(id, values)
+		if !ok {
+			// job removed while it was in the ready list
+			q.rds.ZRem(ctx, q.processingKey(), id)
+			return true
+		}
+		q.processJob(j)
+		return true
+	}
+	return false
+}
+
+func (q *queueRedis) processJob(j *redisJob) {
+	ctx := context.Background()
+	handler, options, ok := q.getHandler(j.Name)
+	if !ok {
+		_, _ = q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			q.requeueJob(ctx, pipe, j.ID, j.Name)
+			return nil
+		})
+		return
+	}
+
+	limitKey := ""
+	if options.Limit.enabled() {
+		limitKey = options.Limit.key(j.Name, j.Payload)
+		delay, err := q.acquireJobLimit(options.Limit, limitKey, j.ID, options.Timeout)
+		if err != nil {
+			logrus.Errorf("[qredis] acquire job limit %s: %s", limitKey, err)
+			delay = limitRetryDelay
+		}
+		if delay > 0 {
+			q.deferJob(j, delay)
+			return
+		}
+		defer q.releaseJobLimit(limitKey, j.ID)
+	}
+
+	q.inFlightMutex.Lock()
+	q.inFlight[j.ID] = j.Name
+	q.inFlightMutex.Unlock()
+
+	visitor := jobVisitor{stopChannel: make(chan bool)}
+	go visitor.startVisiting(func() {
+		leaseUntil := float64(unixMilli(time.Now().Add(redisJobLease)))
+		q.rds.ZAddXX(ctx, q.processingKey(), &redis.Z{Score: leaseUntil, Member: j.ID})
+		if limitKey != "" && options.Limit.Concurrency > 0 {
+			q.renewJobLimit(limitKey, j.ID, options.Limit.lease(options.Timeout))
+		}
+	})
+	descriptor := j.descriptor()
+	descriptor.MaxAttempts = options.Retry.maxAttemptsDescriptor()
+	startStatus := j.jobStatus(JobProcessing)
+	q.publishStatus(startStatus)
+	descriptor.progressReporter = func(pct int, message string) error {
+		return q.updateProgress(j.ID, startStatus, pct, message)
+	}
+	startedAt := time.Now()
+	err := handleJobWithTimeout(q.ctx, q.wrap(handler), descriptor, options)
+	visitor.stop()
+
+	q.inFlightMutex.Lock()
+	delete(q.inFlight, j.ID)
+	abandoned := q.abandoned
+	q.inFlightMutex.Unlock()
+	if abandoned {
+		// job already put back to the queue by Shutdown
+		return
+	}
+
+	q.recordAttempt(options.queueName(), j.Name, j.ScheduledAt, startedAt, err)
+	owned := false
+	if err == nil {
+		owned, err = q.completeJob(j, descriptor.result)
+	} else {
+		owned, err = q.failJob(j, options.Retry, err, startedAt, 0)
+	}
+	if err != nil {
+		logrus.Errorf("[qredis] update job %s - %s: %s", j.Name, j.ID, err)
+		return
+	}
+	if !owned {
+		logrus.Debugf("[qredis] job %s - %s attempt %d finished after its lease expired", j.Name, j.ID, j.Attempts)
+		return
+	}
+	q.publishCurrentStatus(j.ID, q.GetJobStatus)
+}
+
+// deferJob put job over its JobLimit back to scheduled set without using up an attempt
+func (q *queueRedis) deferJob(j *redisJob, delay time.Duration) {
+	ctx := context.Background()
+	runAt := time.Now().Add(delay)
+	_, err := q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.processingKey(), j.ID)
+		pipe.HIncrBy(ctx, q.jobKey(j.ID), "attempts", -1)
+		pipe.HSet(ctx, q.jobKey(j.ID), "scheduled_at", unixMilli(runAt))
+		pipe.ZAdd(ctx, q.scheduledKey(), &redis.Z{Score: float64(unixMilli(runAt)), Member: j.ID})
+		return nil
 	})
+	if err != nil {
+		logrus.Errorf("[qredis] defer job %s - %s: %s", j.Name, j.ID, err)
+	}
+}
+
+// takeUniqueKeyScript take unique key without expiry so it is held as long as
+// its job waits or runs, key whose job hash is gone is taken over as the job
+// was deleted without releasing it. key with expiry is kept for uniqueness window
+//
+// KEYS[1] unique key, KEYS[2] job hash of the current holder
+// ARGV job id, current holder id
+var takeUniqueKeyScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder then
+	if holder ~= ARGV[2] or redis.call('PTTL', KEYS[1]) ~= -1 or redis.call('EXISTS', KEYS[2]) == 1 then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+// takeUniqueKey take unique key for job id, false means a duplicate holds it
+func (q *queueRedis) takeUniqueKey(ctx context.Context, key string, id string) (bool, error) {
+	holder, err := q.rds.Get(ctx, q.uniqueKey(key)).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	taken, err := takeUniqueKeyScript.Run(ctx, q.rds, []string{q.uniqueKey(key), q.jobKey(holder)}, id, holder).Int()
+	return taken == 1, err
 }
 
-func (q *queueImpl) Start() {
-	q.worker.Start()
+// completeJobScript keep finished job with its result for ttl, unique job either
+// keeps its key for the uniqueness window or releases it right away. it returns
+// 0 when the attempt no longer owns the job because its lease expired
+//
+// KEYS[1] processing zset, KEYS[2] job hash, KEYS[3] unique key
+// ARGV job id, attempt, result, now ms, ttl ms, uniqueness window ms
+var completeJobScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], 'attempts') ~= ARGV[2] or redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], 'result', ARGV[3], 'completed_at', ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+if redis.call('GET', KEYS[3]) == ARGV[1] then
+	if tonumber(ARGV[6]) > 0 then
+		redis.call('SET', KEYS[3], ARGV[1], 'PX', ARGV[6])
+	else
+		redis.call('DEL', KEYS[3])
+	end
+end
+return 1
+`)
+
+// completeJob finish the job unless its attempt lost the lease, the way
+// queueDB guards on attempts, the job then belongs to the next attempt
+func (q *queueRedis) completeJob(j *redisJob, result string) (bool, error) {
+	completed, err := completeJobScript.Run(context.Background(), q.rds,
+		[]string{q.processingKey(), q.jobKey(j.ID), q.uniqueKey(j.UniqueKey)},
+		j.ID,
+		j.Attempts,
+		result,
+		unixMilli(time.Now()),
+		int64(q.options.ResultTTL/time.Millisecond),
+		int64(j.UniqueFor/time.Millisecond),
+	).Int()
+	return completed == 1, err
+}
+
+// releaseUniqueScript keep uniqueness key for window or delete it, only while it
+// is still held by the job as it may have been taken by a duplicate
+//
+// KEYS[1] unique key
+// ARGV job id, window ms
+var releaseUniqueScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+else
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+
+func (q *queueRedis) releaseUniqueKey(ctx context.Context, pipe redis.Pipeliner, j *redisJob, window time.Duration) {
+	releaseUniqueScript.Eval(ctx, pipe, []string{q.uniqueKey(j.UniqueKey)}, j.ID, int64(window/time.Millisecond))
+}
+
+// failJobScript record failed attempt, the job is scheduled to run again at the
+// given time or moved to failed set releasing its unique key. unique_key field is
+// kept so the job takes the key again once retried. it returns 0 when the attempt
+// no longer owns the job, or its lease was renewed past max lease when it is set
+//
+// KEYS[1] processing zset, KEYS[2] job hash, KEYS[3] scheduled zset,
+// KEYS[4] failed zset, KEYS[5] unique key
+// ARGV job id, attempt, error, history, retry flag, run or fail time ms, max lease ms
+var failJobScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], 'attempts') ~= ARGV[2] then
+	return 0
+end
+local lease = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not lease or (tonumber(ARGV[7]) > 0 and tonumber(lease) > tonumber(ARGV[7])) then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[2], 'last_error', ARGV[3], 'history', ARGV[4])
+if ARGV[5] == '1' then
+	redis.call('HSET', KEYS[2], 'scheduled_at', ARGV[6])
+	redis.call('ZADD', KEYS[3], ARGV[6], ARGV[1])
+	return 1
+end
+redis.call('HSET', KEYS[2], 'failed_at', ARGV[6])
+redis.call('ZADD', KEYS[4], ARGV[6], ARGV[1])
+if redis.call('GET', KEYS[5]) == ARGV[1] then
+	redis.call('DEL', KEYS[5])
+end
+return 1
+`)
+
+// failJob schedule failed job after backoff delay or move it to failed set when
+// it is not retryable or ran out of attempts. maxLease greater than zero fails
+// the attempt only while its lease is not renewed past it. false is returned
+// when the attempt no longer owns the job
+func (q *queueRedis) failJob(j *redisJob, policy RetryPolicy, jobErr error, startedAt time.Time, maxLease int64) (bool, error) {
+	history, err := json.Marshal(append(j.History, JobAttempt{
+		Attempt:    len(j.History) + 1,
+		Error:      jobErr.Error(),
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}))
+	if err != nil {
+		return false, err
+	}
+
+	retry := policy.shouldRetry(j.Attempts, jobErr)
+	retryFlag, at := 0, time.Now()
+	if retry {
+		retryFlag, at = 1, at.Add(policy.backoff(j.Attempts))
+	}
+	failed, err := failJobScript.Run(context.Background(), q.rds,
+		[]string{q.processingKey(), q.jobKey(j.ID), q.scheduledKey(), q.failedKey(), q.uniqueKey(j.UniqueKey)},
+		j.ID,
+		j.Attempts,
+		jobErr.Error(),
+		string(history),
+		retryFlag,
+		unixMilli(at),
+		maxLease,
+	).Int()
+	if err != nil || failed == 0 {
+		return false, err
+	}
+	if !retry {
+		logrus.Debugf("[qredis] job %s - %s failed after %d attempts: %s", j.Name, j.ID, j.Attempts, jobErr)
+	}
+	return true, nil
+}
+
+// moveJobScript move id from scheduled set to the ready list of its job,
+// it returns 0 when the id was already moved by another instance
+//
+// KEYS[1] scheduled zset, KEYS[2] ready list
+// ARGV job id
+var moveJobScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+return 1
+`)
+
+// startMoveLoop move due scheduled jobs to their ready list and fail
+// attempts of dead workers
+func (q *queueRedis) startMoveLoop() {
+	defer q.loopsWaitGroup.Done()
+	ticker := time.NewTicker(q.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.moveDueJobs()
+			if count := q.failExpiredJobs(); count > 0 {
+				logrus.Infof("[qredis] %d jobs with expired lease failed their attempt", count)
+			}
+		case <-q.stopChan:
+			logrus.Info("[qredis] move loop stopped")
+			return
+		}
+	}
+}
+
+// moveDueJobs move due scheduled ids in batches, job name of each id
+// is read first so the ready list can be declared to the script
+func (q *queueRedis) moveDueJobs() int {
+	ctx := context.Background()
+	sourceKey := q.scheduledKey()
+	total := 0
+	for {
+		ids, err := q.rds.ZRangeByScore(ctx, sourceKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(unixMilli(time.Now()), 10),
+			Count: redisMoveBatchSize,
+		}).Result()
+		if err != nil {
+			logrus.Errorf("[qredis] move jobs from %s: %s", sourceKey, err)
+			return total
+		}
+
+		names := make([]*redis.StringCmd, len(ids))
+		_, err = q.rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				names[i] = pipe.HGet(ctx, q.jobKey(id), "name")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			logrus.Errorf("[qredis] move jobs from %s: %s", sourceKey, err)
+			return total
+		}
+
+		for i, id := range ids {
+			name := names[i].Val()
+			if name == "" {
+				// job removed while it was waiting
+				q.rds.ZRem(ctx, sourceKey, id)
+				continue
+			}
+			moved, err := moveJobScript.Run(ctx, q.rds,
+				[]string{sourceKey, q.readyKey(name)},
+				id,
+			).Int()
+			if err != nil {
+				logrus.Errorf("[qredis] move job %s from %s: %s", id, sourceKey, err)
+				return total
+			}
+			total += moved
+		}
+		if len(ids) < redisMoveBatchSize {
+			return total
+		}
+	}
+}
+
+// failExpiredJobs record failed attempt of claimed jobs whose lease expired e.g.
+// their worker crashed, the job is retried per its RetryPolicy like in queueDB
+func (q *queueRedis) failExpiredJobs() int {
+	ctx := context.Background()
+	total := 0
+	for {
+		now := unixMilli(time.Now())
+		ids, err := q.rds.ZRangeByScore(ctx, q.processingKey(), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(now, 10),
+			Count: redisMoveBatchSize,
+		}).Result()
+		if err != nil {
+			logrus.Errorf("[qredis] fail expired jobs: %s", err)
+			return total
+		}
+
+		failedInBatch := 0
+		for _, id := range ids {
+			failed, err := q.failExpiredJob(ctx, id, now)
+			if err != nil {
+				logrus.Errorf("[qredis] fail expired job %s: %s", id, err)
+				return total
+			}
+			if failed {
+				failedInBatch++
+			}
+		}
+		total += failedInBatch
+		if len(ids) < redisMoveBatchSize || failedInBatch == 0 {
+			return total
+		}
+	}
+}
+
+// failExpiredJob fail current attempt of the job with ErrJobLeaseExpired, false is
+// returned when its worker finished it or renewed the lease in the meantime
+func (q *queueRedis) failExpiredJob(ctx context.Context, id string, now int64) (bool, error) {
+	values, err := q.rds.HGetAll(ctx, q.jobKey(id)).Result()
+	if err != nil {
+		return false, err
+	}
+	j, ok := parseRedisJob(id, values)
+	if !ok {
+		// job removed while it was processing
+		return false, q.rds.ZRem(ctx, q.processingKey(), id).Err()
+	}
+
+	_, options, _ := q.getHandler(j.Name)
+	failed, err := q.failJob(j, options.Retry, ErrJobLeaseExpired, j.StartedAt, now)
+	if err != nil || !failed {
+		return false, err
+	}
+
+	logrus.Debugf("[qredis] job %s - %s attempt %d lost its lease", j.Name, j.ID, j.Attempts)
+	q.publishCurrentStatus(j.ID, q.GetJobStatus)
+	if !options.Retry.shouldRetry(j.Attempts, ErrJobLeaseExpired) {
+		q.handlerMutex.Lock()
+		callback := q.lostCallbacks[j.Name]
+		q.handlerMutex.Unlock()
+		if callback != nil {
+			callback(j.descriptor(), ErrJobLeaseExpired)
+		}
+	}
+	return true, nil
+}
+
+// jobLimitScript take a concurrency slot and record a start for JobLimit atomically.
+// it returns zero when job may start or milliseconds the job has to wait
+//
+// KEYS[1] running slots zset, KEYS[2] starts zset
+// ARGV now ms, job id, lease ms, concurrency, rate, window ms
+var jobLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local concurrency = tonumber(ARGV[4])
+local rate = tonumber(ARGV[5])
+local window = tonumber(ARGV[6])
+
+if concurrency > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	if redis.call('ZCARD', KEYS[1]) >= concurrency then
+		return -1
+	end
+end
+
+if rate > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - window)
+	if redis.call('ZCARD', KEYS[2]) >= rate then
+		local oldest = redis.call('ZRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+		return math.max(tonumber(oldest[2]) + window - now, 1)
+	end
+	redis.call('ZADD', KEYS[2], now, ARGV[2] .. ':' .. now)
+	redis.call('PEXPIRE', KEYS[2], window)
+end
+
+if concurrency > 0 then
+	redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[2])
+	redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[3]))
+end
+return 0
+`)
+
+func (q *queueRedis) limitKeys(limitKey string) (string, string) {
+	prefix := q.prefix + "limit:" + limitKey
+	return prefix + ":running", prefix + ":starts"
+}
+
+// acquireJobLimit return how long the job must be deferred, zero means it took
+// a concurrency slot and may start. slot expires after lease in case worker dies,
+// heartbeat of running job renews it
+func (q *queueRedis) acquireJobLimit(limit JobLimit, limitKey string, jobID string, timeout time.Duration) (time.Duration, error) {
+	rate, per := 0, int64(0)
+	if limit.rateEnabled() {
+		rate, per = limit.Rate, int64(limit.Per/time.Millisecond)
+	}
+	runningKey, startsKey := q.limitKeys(limitKey)
+	res, err := jobLimitScript.Run(context.Background(), q.rds,
+		[]string{runningKey, startsKey},
+		unixMilli(time.Now()),
+		jobID,
+		int64(limit.lease(timeout)/time.Millisecond),
+		limit.Concurrency,
+		rate,
+		per,
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if res < 0 {
+		return limitRetryDelay, nil
+	}
+	return time.Duration(res) * time.Millisecond, nil
+}
+
+// renewJobLimit extend concurrency slot of running job so job running longer
+// than the lease, e.g. without timeout, keeps its slot
+func (q *queueRedis) renewJobLimit(limitKey string, jobID string, lease time.Duration) {
+	ctx := context.Background()
+	runningKey, _ := q.limitKeys(limitKey)
+	_, err := q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddXX(ctx, runningKey, &redis.Z{Score: float64(unixMilli(time.Now().Add(lease))), Member: jobID})
+		pipe.PExpire(ctx, runningKey, lease)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("[qredis] renew job limit %s: %s", limitKey, err)
+	}
 }
 
-func (q *queueImpl) Close() {
-	q.worker.Stop()
-	if err := q.enqueuer.Pool.Close(); err != nil {
-		logrus.Errorf("err closing queue worker pool: %s", err)
+func (q *queueRedis) releaseJobLimit(limitKey string, jobID string) {
+	runningKey, _ := q.limitKeys(limitKey)
+	if err := q.rds.ZRem(context.Background(), runningKey, jobID).Err(); err != nil {
+		logrus.Errorf("err releasing job limit %s: %s", limitKey, err)
 	}
 }
@@ -0,0 +1,217 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// failed jobs keep their hash with attempt history, their ids are
+// in failed set ordered by fail time and read 100 per page
+
+const failedScanPageSize = 100
+
+func (q *queueRedis) FailedJobs(jobName string, offset int, limit int) ([]FailedJob, error) {
+	// without job name filter offset is an index of the failed set
+	start := int64(0)
+	if jobName == "" && offset > 0 {
+		start, offset = int64(offset), 0
+	}
+
+	var failedJobs []FailedJob
+	skipped := 0
+	err := q.iterateFailedJobs(jobName, start, func(j *redisJob) bool {
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		failedJobs = append(failedJobs, q.failedJobDescriptor(j))
+		return limit <= 0 || len(failedJobs) < limit
+	})
+	return failedJobs, err
+}
+
+func (q *queueRedis) RetryFailedJob(id string) error {
+	ctx := context.Background()
+	fields, err := q.rds.HMGet(ctx, q.jobKey(id), "name", "unique_key").Result()
+	if err != nil {
+		return err
+	}
+	jobName, _ := fields[0].(string)
+	uniqueKey, _ := fields[1].(string)
+
+	retried, err := q.retryFailedJob(id, jobName, uniqueKey)
+	if err != nil {
+		return err
+	}
+	if !retried {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return nil
+}
+
+func (q *queueRedis) RetryFailedJobs(jobName string) (int, error) {
+	failedJobs, err := q.collectFailedJobs(jobName)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, j := range failedJobs {
+		retried, err := q.retryFailedJob(j.ID, j.Name, j.UniqueKey)
+		if err != nil {
+			return count, err
+		}
+		if retried {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// retryFailedJob put failed job back to its ready list with fresh attempts, unique
+// job takes its key again unless a duplicate was added since it failed
+func (q *queueRedis) retryFailedJob(id string, jobName string, uniqueKey string) (bool, error) {
+	ctx := context.Background()
+	removed, err := q.rds.ZRem(ctx, q.failedKey(), id).Result()
+	if err != nil || removed == 0 || jobName == "" {
+		return false, err
+	}
+
+	keyTaken := true
+	if uniqueKey != "" {
+		keyTaken, err = q.takeUniqueKey(ctx, uniqueKey, id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.jobKey(id), "attempts", 0)
+		pipe.HDel(ctx, q.jobKey(id), "failed_at")
+		if !keyTaken {
+			pipe.HDel(ctx, q.jobKey(id), "unique_key")
+		}
+		pipe.LPush(ctx, q.readyKey(jobName), id)
+		return nil
+	})
+	return err == nil, err
+}
+
+func (q *queueRedis) DeleteFailedJob(id string) error {
+	deleted, err := q.deleteFailedJob(id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("failed job %s not found", id)
+	}
+	return nil
+}
+
+func (q *queueRedis) DeleteFailedJobs(jobName string) (int, error) {
+	failedJobs, err := q.collectFailedJobs(jobName)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, j := range failedJobs {
+		deleted, err := q.deleteFailedJob(j.ID)
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (q *queueRedis) deleteFailedJob(id string) (bool, error) {
+	ctx := context.Background()
+	removed, err := q.rds.ZRem(ctx, q.failedKey(), id).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	return true, q.rds.Del(ctx, q.jobKey(id)).Err()
+}
+
+// ExportFailedJobs scan failed set once instead of paging with offset
+func (q *queueRedis) ExportFailedJobs(w io.Writer, jobName string) error {
+	encoder := json.NewEncoder(w)
+	var encodeErr error
+	err := q.iterateFailedJobs(jobName, 0, func(j *redisJob) bool {
+		encodeErr = encoder.Encode(q.failedJobDescriptor(j))
+		return encodeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return encodeErr
+}
+
+// iterateFailedJobs call fn for every failed job matching jobName from index start
+// of the failed set until fn returns false
+func (q *queueRedis) iterateFailedJobs(jobName string, start int64, fn func(j *redisJob) bool) error {
+	ctx := context.Background()
+	for ; ; start += failedScanPageSize {
+		ids, err := q.rds.ZRange(ctx, q.failedKey(), start, start+failedScanPageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		cmds := make([]*redis.StringStringMapCmd, len(ids))
+		_, err = q.rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				cmds[i] = pipe.HGetAll(ctx, q.jobKey(id))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			j, ok := parseRedisJob(id, cmds[i].Val())
+			if !ok || (jobName != "" && j.Name != jobName) {
+				continue
+			}
+			if !fn(j) {
+				return nil
+			}
+		}
+	}
+}
+
+// collectFailedJobs collect matching failed jobs first so the failed
+// set is not modified while it is still being paginated
+func (q *queueRedis) collectFailedJobs(jobName string) ([]*redisJob, error) {
+	var failedJobs []*redisJob
+	err := q.iterateFailedJobs(jobName, 0, func(j *redisJob) bool {
+		failedJobs = append(failedJobs, j)
+		return true
+	})
+	return failedJobs, err
+}
+
+func (q *queueRedis) failedJobDescriptor(j *redisJob) FailedJob {
+	q.handlerMutex.Lock()
+	options := q.jobOptions[j.Name]
+	q.handlerMutex.Unlock()
+
+	descriptor := j.descriptor()
+	descriptor.MaxAttempts = options.Retry.maxAttemptsDescriptor()
+	return FailedJob{
+		Job:      *descriptor,
+		Error:    j.LastError,
+		FailedAt: j.FailedAt,
+		History:  j.History,
+	}
+}
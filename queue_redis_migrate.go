@@ -0,0 +1,156 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// gocraftJob job as serialized by gocraft/work which backed redis queue before
+type gocraftJob struct {
+	Name       string                 `json:"name"`
+	ID         string                 `json:"id"`
+	EnqueuedAt int64                  `json:"t"`
+	Args       map[string]interface{} `json:"args"`
+	Fails      int64                  `json:"fails"`
+	LastErr    string                 `json:"err"`
+}
+
+func (j *gocraftJob) payload() string {
+	payload, _ := j.Args["payload"].(string)
+	return payload
+}
+
+// MigrateGocraftJobs move jobs left in gocraft keys of gocraftNamespace, the app name
+// given to the old NewQueueRedis, to redis queue with namespace. workers of the old
+// version must be stopped first. waiting, in progress, scheduled, retry and dead jobs
+// are moved keeping their id and fails count, in progress jobs of stopped workers are
+// run again from the start. gocraft unique locks are not migrated
+func MigrateGocraftJobs(client redis.UniversalClient, gocraftNamespace string, namespace string) (int, error) {
+	q := newQueueRedis(QueueRedisOptions{Client: client, Namespace: namespace})
+	ctx := context.Background()
+	oldPrefix := redisNamespacePrefix(gocraftNamespace)
+
+	jobNames, err := client.SMembers(ctx, oldPrefix+"known_jobs").Result()
+	if err != nil {
+		return 0, err
+	}
+	// gocraft keeps jobs being processed in a list per worker pool
+	poolIDs, err := client.SMembers(ctx, oldPrefix+"worker_pools").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, jobName := range jobNames {
+		listKeys := []string{oldPrefix + "jobs:" + jobName}
+		for _, poolID := range poolIDs {
+			listKeys = append(listKeys, oldPrefix+"jobs:"+jobName+":"+poolID+":inprogress")
+		}
+		for _, listKey := range listKeys {
+			count, err := q.migrateGocraftList(ctx, listKey)
+			total += count
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	for _, zsetKey := range []string{oldPrefix + "scheduled", oldPrefix + "retry", oldPrefix + "dead"} {
+		dead := zsetKey == oldPrefix+"dead"
+		for {
+			entries, err := client.ZRangeWithScores(ctx, zsetKey, 0, 99).Result()
+			if err != nil {
+				return total, err
+			}
+			if len(entries) == 0 {
+				break
+			}
+			for _, entry := range entries {
+				rawJSON := fmt.Sprint(entry.Member)
+				if err := q.migrateGocraftJob(rawJSON, time.Unix(int64(entry.Score), 0), dead); err != nil {
+					return total, err
+				}
+				if err := client.ZRem(ctx, zsetKey, rawJSON).Err(); err != nil {
+					return total, err
+				}
+				total++
+			}
+		}
+	}
+	return total, nil
+}
+
+// migrateGocraftList move jobs of gocraft list to the queue oldest first, a job
+// is removed from the list only after it was written to the new queue
+func (q *queueRedis) migrateGocraftList(ctx context.Context, listKey string) (int, error) {
+	count := 0
+	for {
+		rawJSON, err := q.rds.LIndex(ctx, listKey, -1).Result()
+		if err == redis.Nil {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := q.migrateGocraftJob(rawJSON, time.Now(), false); err != nil {
+			return count, err
+		}
+		if err := q.rds.LRem(ctx, listKey, -1, rawJSON).Err(); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// migrateGocraftJob write gocraft job to the queue, at is run time of
+// waiting job or fail time of dead job
+func (q *queueRedis) migrateGocraftJob(rawJSON string, at time.Time, dead bool) error {
+	var old gocraftJob
+	if err := json.Unmarshal([]byte(rawJSON), &old); err != nil {
+		return fmt.Errorf("invalid gocraft job %s: %w", rawJSON, err)
+	}
+
+	extra := map[string]interface{}{
+		"attempts":    old.Fails,
+		"enqueued_at": old.EnqueuedAt * 1000,
+	}
+	if old.LastErr != "" {
+		extra["last_error"] = old.LastErr
+	}
+	if !dead {
+		_, err := q.enqueue(old.ID, old.Name, old.payload(), at, extra)
+		return err
+	}
+
+	history, err := json.Marshal([]JobAttempt{{
+		Attempt:    int(old.Fails),
+		Error:      old.LastErr,
+		StartedAt:  at,
+		FinishedAt: at,
+	}})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	fields := map[string]interface{}{
+		"name":         old.Name,
+		"payload":      old.payload(),
+		"scheduled_at": old.EnqueuedAt * 1000,
+		"history":      string(history),
+		"failed_at":    unixMilli(at),
+	}
+	for field, value := range extra {
+		fields[field] = value
+	}
+	_, err = q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.jobKey(old.ID), fields)
+		pipe.ZAdd(ctx, q.failedKey(), &redis.Z{Score: float64(unixMilli(at)), Member: old.ID})
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,72 @@
+package gocommonweb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func (q *queueRedis) AddJobAt(jobName string, payload string, runAt time.Time) (string, error) {
+	return q.enqueue(newRedisJobID(), jobName, payload, runAt, nil)
+}
+
+func (q *queueRedis) CancelJob(id string) error {
+	j, err := q.removePendingJob(id)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err = q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, q.jobKey(id))
+		if j.UniqueKey != "" {
+			q.releaseUniqueKey(ctx, pipe, j, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+func (q *queueRedis) Reschedule(id string, runAt time.Time) error {
+	if _, err := q.removePendingJob(id); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err := q.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.jobKey(id), "scheduled_at", unixMilli(runAt))
+		pipe.ZAdd(ctx, q.scheduledKey(), &redis.Z{Score: float64(unixMilli(runAt)), Member: id})
+		return nil
+	})
+	return err
+}
+
+// removePendingJob take job out of scheduled set or its ready list, ErrJobNotPending
+// is returned when the job is unknown or a worker already claimed it
+func (q *queueRedis) removePendingJob(id string) (*redisJob, error) {
+	ctx := context.Background()
+	values, err := q.rds.HGetAll(ctx, q.jobKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	j, ok := parseRedisJob(id, values)
+	if !ok {
+		return nil, ErrJobNotPending
+	}
+
+	removed, err := q.rds.ZRem(ctx, q.scheduledKey(), id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if removed == 0 {
+		removed, err = q.rds.LRem(ctx, q.readyKey(j.Name), 1, id).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if removed == 0 {
+		return nil, ErrJobNotPending
+	}
+	return j, nil
+}
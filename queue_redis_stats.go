@@ -0,0 +1,155 @@
+package gocommonweb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Stats count jobs of every known job name, queue of a job name is taken from
+// job options of this process. counts are reused for StatsCacheTTL as counting
+// is O(jobs), attempt counters of this process are always current
+func (q *queueRedis) Stats() ([]JobStats, error) {
+	q.statsMutex.Lock()
+	defer q.statsMutex.Unlock()
+	if q.statsCache == nil || time.Since(q.statsCachedAt) >= q.options.StatsCacheTTL {
+		counts, err := q.countJobs()
+		if err != nil {
+			return nil, err
+		}
+		q.statsCache, q.statsCachedAt = counts, time.Now()
+	}
+
+	set := make(jobStatsSet)
+	for _, counts := range q.statsCache {
+		*set.get(counts.Queue, counts.JobName) = counts
+	}
+	return q.mergeAttempts(set), nil
+}
+
+// countJobs count jobs by job name, ready lists are counted by their length
+// while scheduled, processing and failed sets are scanned for the job names
+func (q *queueRedis) countJobs() ([]JobStats, error) {
+	ctx := context.Background()
+	jobNames, err := q.rds.SMembers(ctx, q.knownJobsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	set := make(jobStatsSet)
+	statsOf := func(jobName string) *JobStats {
+		return set.get(q.jobQueueName(jobName), jobName)
+	}
+
+	if err := q.readyStats(jobNames, now, statsOf); err != nil {
+		return nil, err
+	}
+
+	err = q.scanJobSet(q.scheduledKey(), func(id string, jobName string, score float64) {
+		stats := statsOf(jobName)
+		stats.Waiting++
+		// due jobs not moved to their ready list yet
+		if age := oldestWaiting(time.Unix(0, int64(score)*int64(time.Millisecond)), now); age > stats.OldestWaiting {
+			stats.OldestWaiting = age
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.scanJobSet(q.processingKey(), func(id string, jobName string, score float64) {
+		statsOf(jobName).Processing++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.scanJobSet(q.failedKey(), func(id string, jobName string, score float64) {
+		statsOf(jobName).Failed++
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set.list(), nil
+}
+
+// readyStats count ready lists, the oldest ready job is at the right end
+func (q *queueRedis) readyStats(jobNames []string, now time.Time, statsOf func(jobName string) *JobStats) error {
+	ctx := context.Background()
+	lenCmds := make([]*redis.IntCmd, len(jobNames))
+	oldestCmds := make([]*redis.StringCmd, len(jobNames))
+	_, err := q.rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, jobName := range jobNames {
+			lenCmds[i] = pipe.LLen(ctx, q.readyKey(jobName))
+			oldestCmds[i] = pipe.LIndex(ctx, q.readyKey(jobName), -1)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	scheduledCmds := make([]*redis.StringCmd, len(jobNames))
+	_, err = q.rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, cmd := range oldestCmds {
+			if cmd.Val() != "" {
+				scheduledCmds[i] = pipe.HGet(ctx, q.jobKey(cmd.Val()), "scheduled_at")
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	for i, jobName := range jobNames {
+		stats := statsOf(jobName)
+		stats.Waiting += lenCmds[i].Val()
+		if scheduledCmds[i] != nil {
+			if age := oldestWaiting(parseUnixMilli(scheduledCmds[i].Val()), now); age > stats.OldestWaiting {
+				stats.OldestWaiting = age
+			}
+		}
+	}
+	return nil
+}
+
+// scanJobSet call fn with job name of every id in zset key, reading failedScanPageSize ids at a time
+func (q *queueRedis) scanJobSet(key string, fn func(id string, jobName string, score float64)) error {
+	ctx := context.Background()
+	for start := int64(0); ; start += failedScanPageSize {
+		entries, err := q.rds.ZRangeWithScores(ctx, key, start, start+failedScanPageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		cmds := make([]*redis.StringCmd, len(entries))
+		_, err = q.rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range entries {
+				cmds[i] = pipe.HGet(ctx, q.jobKey(fmt.Sprint(entry.Member)), "name")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		for i, entry := range entries {
+			if jobName := cmds[i].Val(); jobName != "" {
+				fn(fmt.Sprint(entry.Member), jobName, entry.Score)
+			}
+		}
+	}
+}
+
+func (q *queueRedis) jobQueueName(jobName string) string {
+	q.handlerMutex.Lock()
+	defer q.handlerMutex.Unlock()
+	return q.jobOptions[jobName].queueName()
+}
@@ -0,0 +1,70 @@
+package gocommonweb
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GetJobStatus status of a job is not stored, it is derived from fields set
+// when the job completes or fails and from the processing set
+func (q *queueRedis) GetJobStatus(id string) (*JobStatus, error) {
+	ctx := context.Background()
+	values, err := q.rds.HGetAll(ctx, q.jobKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	j, ok := parseRedisJob(id, values)
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	var status JobStatus
+	switch {
+	case !j.CompletedAt.IsZero():
+		status = j.jobStatus(JobComplete)
+	case !j.FailedAt.IsZero():
+		status = j.jobStatus(JobFailed)
+	default:
+		err := q.rds.ZScore(ctx, q.processingKey(), id).Err()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if err == nil {
+			status = j.jobStatus(JobProcessing)
+		} else {
+			status = j.jobStatus(JobWaiting)
+		}
+	}
+	return &status, nil
+}
+
+// updateProgress store progress of running job, status is the job status when the attempt started
+func (q *queueRedis) updateProgress(id string, status JobStatus, pct int, message string) error {
+	ctx := context.Background()
+	err := q.rds.HSet(ctx, q.jobKey(id), "progress", pct, "progress_message", message).Err()
+	if err != nil {
+		return err
+	}
+
+	status.Progress = pct
+	status.ProgressMessage = message
+	q.publishStatus(status)
+	return nil
+}
+
+func (j *redisJob) jobStatus(status string) JobStatus {
+	jobStatus := JobStatus{
+		ID:              j.ID,
+		Name:            j.Name,
+		Status:          status,
+		Attempt:         j.Attempts,
+		Progress:        j.Progress,
+		ProgressMessage: j.ProgressMessage,
+		Result:          j.Result,
+	}
+	if status != JobComplete {
+		jobStatus.Error = j.LastError
+	}
+	return jobStatus
+}
@@ -0,0 +1,457 @@
+package gocommonweb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestRedis redis client of in-memory server closed when the test ends
+func openTestRedis(t *testing.T) *redis.Client {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func openTestQueueRedis(t *testing.T) (*queueRedis, *redis.Client) {
+	client := openTestRedis(t)
+	queue := newQueueRedis(QueueRedisOptions{Client: client, Namespace: "test"})
+	t.Cleanup(queue.Close)
+	return queue, client
+}
+
+func TestQueueRedisClaimAndComplete(t *testing.T) {
+	queue, client := openTestQueueRedis(t)
+	ctx := context.Background()
+
+	var handled []string
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Payload)
+		require.Equal(t, 1, job.Attempt)
+		job.SetResult("sent " + job.Payload)
+		return nil
+	}))
+
+	require.False(t, queue.processNextJob(DefaultQueueName))
+	first, err := queue.AddJobAt("send_email", "a", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, queue.AddJob("send_email", "b"))
+
+	// claimed job is marked processing and its attempt counted
+	id, err := queue.claimJob(ctx, "send_email")
+	require.NoError(t, err)
+	require.Equal(t, first, id)
+	_, err = client.ZScore(ctx, queue.processingKey(), id).Result()
+	require.NoError(t, err)
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobProcessing, status.Status)
+	require.Equal(t, 1, status.Attempt)
+
+	// put the claim back as it was before
+	client.ZRem(ctx, queue.processingKey(), id)
+	client.HIncrBy(ctx, queue.jobKey(id), "attempts", -1)
+	client.RPush(ctx, queue.readyKey("send_email"), id)
+
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.False(t, queue.processNextJob(DefaultQueueName))
+	require.Equal(t, []string{"a", "b"}, handled)
+
+	status, err = queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobComplete, status.Status)
+	require.Equal(t, "sent a", status.Result)
+	count, err := client.ZCard(ctx, queue.processingKey()).Result()
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestQueueRedisRetryAndDelayedJobs(t *testing.T) {
+	queue, client := openTestQueueRedis(t)
+	ctx := context.Background()
+
+	errDown := errors.New("service down")
+	queue.SetJobOptions("call_api", JobOptions{Retry: RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     func(attempt int) time.Duration { return time.Hour },
+	}})
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errDown
+	}))
+
+	id, err := queue.AddJobAt("call_api", "1", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, queue.processNextJob(DefaultQueueName))
+	require.Zero(t, queue.moveDueJobs())
+
+	// due delayed job is promoted to the ready list
+	client.ZAdd(ctx, queue.scheduledKey(), &redis.Z{Score: 0, Member: id})
+	require.Equal(t, 1, queue.moveDueJobs())
+	require.True(t, queue.processNextJob(DefaultQueueName))
+
+	// failed attempt is backed off in the scheduled set
+	score, err := client.ZScore(ctx, queue.scheduledKey(), id).Result()
+	require.NoError(t, err)
+	require.InDelta(t, float64(unixMilli(time.Now().Add(time.Hour))), score, float64(time.Minute/time.Millisecond))
+	require.False(t, queue.processNextJob(DefaultQueueName))
+
+	client.ZAdd(ctx, queue.scheduledKey(), &redis.Z{Score: 0, Member: id})
+	require.Equal(t, 1, queue.moveDueJobs())
+	require.True(t, queue.processNextJob(DefaultQueueName))
+
+	// out of attempts
+	failedJobs, err := queue.FailedJobs("call_api", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Equal(t, id, failedJobs[0].ID)
+	require.Equal(t, errDown.Error(), failedJobs[0].Error)
+	require.Len(t, failedJobs[0].History, 2)
+	count, err := client.ZCard(ctx, queue.scheduledKey()).Result()
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestQueueRedisJobDescriptor(t *testing.T) {
+	queue, _ := openTestQueueRedis(t)
+
+	var seen []Job
+	handler := &recordedJobHandler{}
+	queue.SetJobOptions("send_email", JobOptions{Retry: RetryPolicy{MaxAttempts: 3, Backoff: ConstantBackoff(0)}})
+	queue.AddJobHandler("send_email", handler)
+	queue.Use(func(next JobContextHandler) JobContextHandler {
+		return JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+			seen = append(seen, *job)
+			if job.Attempt == 1 {
+				return errors.New("smtp down")
+			}
+			return next.HandleJob(ctx, job)
+		})
+	})
+
+	enqueuedAt := time.Now()
+	runAt := enqueuedAt.Add(-time.Minute)
+	id, err := queue.AddJobAt("send_email", "a@example.com", runAt)
+	require.NoError(t, err)
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.Equal(t, 1, queue.moveDueJobs())
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.Equal(t, []string{"send_email:a@example.com"}, handler.calls)
+
+	// retry gets the next attempt number and its own schedule
+	require.Len(t, seen, 2)
+	for i, descriptor := range seen {
+		require.Equal(t, id, descriptor.ID)
+		require.Equal(t, "send_email", descriptor.Name)
+		require.Equal(t, "a@example.com", descriptor.Payload)
+		require.Equal(t, i+1, descriptor.Attempt)
+		require.Equal(t, 3, descriptor.MaxAttempts)
+		require.WithinDuration(t, enqueuedAt, descriptor.EnqueuedAt, time.Second)
+	}
+	require.WithinDuration(t, runAt, seen[0].ScheduledAt, time.Millisecond)
+	require.True(t, seen[1].ScheduledAt.After(seen[0].ScheduledAt))
+}
+
+func TestQueueRedisExpiredLease(t *testing.T) {
+	queue, client := openTestQueueRedis(t)
+	ctx := context.Background()
+
+	var lost []string
+	queue.onJobLost("import", func(job *Job, err error) {
+		lost = append(lost, job.ID)
+		require.Equal(t, ErrJobLeaseExpired, err)
+	})
+	queue.SetJobOptions("import", JobOptions{Retry: RetryPolicy{MaxAttempts: 2, Backoff: ConstantBackoff(0)}})
+	require.NoError(t, queue.AddJob("import", "file.csv"))
+
+	// worker claimed the job and crashed
+	id, err := queue.claimJob(ctx, "import")
+	require.NoError(t, err)
+	values, err := client.HGetAll(ctx, queue.jobKey(id)).Result()
+	require.NoError(t, err)
+	stale, _ := parseRedisJob(id, values)
+	require.Zero(t, queue.failExpiredJobs())
+	client.ZAdd(ctx, queue.processingKey(), &redis.Z{Score: 0, Member: id})
+	require.Equal(t, 1, queue.failExpiredJobs())
+
+	status, err := queue.GetJobStatus(id)
+	require.NoError(t, err)
+	require.Equal(t, JobWaiting, status.Status)
+	require.Equal(t, 1, status.Attempt)
+	require.Equal(t, ErrJobLeaseExpired.Error(), status.Error)
+	require.Equal(t, 1, queue.moveDueJobs())
+
+	// stale worker can not finish the job claimed again
+	_, err = queue.claimJob(ctx, "import")
+	require.NoError(t, err)
+	completed, err := queue.completeJob(stale, "done")
+	require.NoError(t, err)
+	require.False(t, completed)
+	failed, err := queue.failJob(stale, RetryPolicy{}, errors.New("boom"), time.Now(), 0)
+	require.NoError(t, err)
+	require.False(t, failed)
+
+	// out of attempts the job fails and its lost callback is called
+	client.ZAdd(ctx, queue.processingKey(), &redis.Z{Score: 0, Member: id})
+	require.Equal(t, 1, queue.failExpiredJobs())
+	failedJobs, err := queue.FailedJobs("import", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Len(t, failedJobs[0].History, 2)
+	require.Equal(t, ErrJobLeaseExpired.Error(), failedJobs[0].History[0].Error)
+	require.Equal(t, []string{id}, lost)
+	count, err := client.ZCard(ctx, queue.processingKey()).Result()
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestQueueRedisUniqueJob(t *testing.T) {
+	queue, client := openTestQueueRedis(t)
+	queue.AddJobContextHandler("recalculate_balance", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return nil
+	}))
+
+	enqueued, err := queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-2", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	enqueued, err = queue.AddUniqueJob("recalculate_balance", "user-1", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	// explicit key is kept for the window after completion
+	options := UniqueOptions{Key: "daily-report", Window: time.Hour}
+	queue.AddJobContextHandler("report", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return nil
+	}))
+	enqueued, err = queue.AddUniqueJob("report", "a", options)
+	require.NoError(t, err)
+	require.True(t, enqueued)
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	enqueued, err = queue.AddUniqueJob("report", "b", options)
+	require.NoError(t, err)
+	require.False(t, enqueued)
+
+	// failed job blocks duplicates again once retried
+	queue.SetJobOptions("import", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("import", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errors.New("boom")
+	}))
+	enqueued, err = queue.AddUniqueJob("import", "a", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+
+	// uniqueness key is held as long as the job waits, without expiry
+	ttl, err := client.PTTL(context.Background(), queue.uniqueKey(uniqueJobKey("import", "a", ""))).Result()
+	require.NoError(t, err)
+	require.True(t, ttl < 0)
+
+	for queue.processNextJob(DefaultQueueName) {
+	}
+	failedJobs, err := queue.FailedJobs("import", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.NoError(t, queue.RetryFailedJob(failedJobs[0].ID))
+	enqueued, err = queue.AddUniqueJob("import", "a", UniqueOptions{})
+	require.NoError(t, err)
+	require.False(t, enqueued)
+
+	// key of a job deleted without releasing it is taken over
+	require.NoError(t, client.Del(context.Background(), queue.jobKey(failedJobs[0].ID)).Err())
+	enqueued, err = queue.AddUniqueJob("import", "a", UniqueOptions{})
+	require.NoError(t, err)
+	require.True(t, enqueued)
+}
+
+func TestQueueRedisJobLimit(t *testing.T) {
+	queue, client := openTestQueueRedis(t)
+	ctx := context.Background()
+
+	queue.SetJobOptions("call_api", JobOptions{Limit: JobLimit{Rate: 1, Per: time.Hour}})
+	queue.AddJobContextHandler("call_api", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return nil
+	}))
+
+	require.NoError(t, queue.AddJob("call_api", "1"))
+	second, err := queue.AddJobAt("call_api", "2", time.Now())
+	require.NoError(t, err)
+	require.True(t, queue.processNextJob(DefaultQueueName))
+
+	// second job is deferred until the window frees up without using up an attempt
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	score, err := client.ZScore(ctx, queue.scheduledKey(), second).Result()
+	require.NoError(t, err)
+	require.Greater(t, score, float64(unixMilli(time.Now().Add(time.Minute*59))))
+	status, err := queue.GetJobStatus(second)
+	require.NoError(t, err)
+	require.Equal(t, JobWaiting, status.Status)
+	require.Equal(t, 0, status.Attempt)
+
+	// concurrency slot is held while the job runs
+	delay, err := queue.acquireJobLimit(JobLimit{Concurrency: 1}, "sync_account", "1", 0)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+	delay, err = queue.acquireJobLimit(JobLimit{Concurrency: 1}, "sync_account", "2", 0)
+	require.NoError(t, err)
+	require.Equal(t, limitRetryDelay, delay)
+	queue.releaseJobLimit("sync_account", "1")
+	delay, err = queue.acquireJobLimit(JobLimit{Concurrency: 1}, "sync_account", "2", 0)
+	require.NoError(t, err)
+	require.Zero(t, delay)
+
+	// heartbeat renews the slot of job running past its lease
+	queue.renewJobLimit("sync_account", "2", limitLeaseDuration*2)
+	runningKey, _ := queue.limitKeys("sync_account")
+	score, err = client.ZScore(ctx, runningKey, "2").Result()
+	require.NoError(t, err)
+	require.Greater(t, score, float64(unixMilli(time.Now().Add(limitLeaseDuration))))
+	ttl, err := client.PTTL(ctx, runningKey).Result()
+	require.NoError(t, err)
+	require.Greater(t, int64(ttl), int64(limitLeaseDuration))
+}
+
+func TestQueueRedisStats(t *testing.T) {
+	queue, _ := openTestQueueRedis(t)
+	queue.SetJobOptions("send_email", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("send_email", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errors.New("smtp down")
+	}))
+
+	require.NoError(t, queue.AddJob("send_email", "a"))
+	require.NoError(t, queue.AddDelayedJob("send_email", "b", 3600))
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	require.NoError(t, queue.AddJob("send_email", "c"))
+
+	stats, err := queue.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Equal(t, int64(2), stats[0].Waiting)
+	require.Equal(t, int64(1), stats[0].Failed)
+	require.Equal(t, int64(1), stats[0].FailedAttempts)
+
+	// counts are reused within StatsCacheTTL, attempts are not
+	require.True(t, queue.processNextJob(DefaultQueueName))
+	stats, err = queue.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats[0].Waiting)
+	require.Equal(t, int64(1), stats[0].Failed)
+	require.Equal(t, int64(2), stats[0].FailedAttempts)
+
+	queue.statsCachedAt = time.Time{}
+	stats, err = queue.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats[0].Waiting)
+	require.Equal(t, int64(2), stats[0].Failed)
+}
+
+func TestMigrateGocraftJobs(t *testing.T) {
+	client := openTestRedis(t)
+	ctx := context.Background()
+	oldPrefix := "myapp:"
+
+	client.SAdd(ctx, oldPrefix+"known_jobs", "send_email")
+	client.LPush(ctx, oldPrefix+"jobs:send_email",
+		`{"name":"send_email","id":"w1","t":1600000000,"args":{"payload":"a"}}`,
+		`{"name":"send_email","id":"w2","t":1600000000,"args":{"payload":"b"}}`,
+	)
+	client.SAdd(ctx, oldPrefix+"worker_pools", "pool1")
+	client.LPush(ctx, oldPrefix+"jobs:send_email:pool1:inprogress",
+		`{"name":"send_email","id":"p1","t":1600000000,"fails":1,"args":{"payload":"e"}}`,
+	)
+	client.ZAdd(ctx, oldPrefix+"scheduled", &redis.Z{
+		Score:  float64(time.Now().Add(time.Hour).Unix()),
+		Member: `{"name":"send_email","id":"s1","t":1600000000,"args":{"payload":"c"}}`,
+	})
+	client.ZAdd(ctx, oldPrefix+"dead", &redis.Z{
+		Score:  1600000100,
+		Member: `{"name":"send_email","id":"d1","t":1600000000,"fails":3,"err":"smtp down","args":{"payload":"d"}}`,
+	})
+
+	count, err := MigrateGocraftJobs(client, "myapp", "test")
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+
+	queue := newQueueRedis(QueueRedisOptions{Client: client, Namespace: "test"})
+	ready, err := client.LRange(ctx, queue.readyKey("send_email"), 0, -1).Result()
+	require.NoError(t, err)
+	require.Equal(t, []string{"p1", "w2", "w1"}, ready)
+	_, err = client.ZScore(ctx, queue.scheduledKey(), "s1").Result()
+	require.NoError(t, err)
+	failedJobs, err := queue.FailedJobs("send_email", 0, 10)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, 1)
+	require.Equal(t, "smtp down", failedJobs[0].Error)
+	require.Equal(t, 3, failedJobs[0].Attempt)
+	for _, key := range []string{"jobs:send_email", "jobs:send_email:pool1:inprogress", "scheduled", "dead"} {
+		exists, err := client.Exists(ctx, oldPrefix+key).Result()
+		require.NoError(t, err)
+		require.Zero(t, exists, key)
+	}
+
+	// job that can not be migrated stays in gocraft keys
+	client.LPush(ctx, oldPrefix+"jobs:send_email", "not json")
+	_, err = MigrateGocraftJobs(client, "myapp", "test")
+	require.Error(t, err)
+	left, err := client.LRange(ctx, oldPrefix+"jobs:send_email", 0, -1).Result()
+	require.NoError(t, err)
+	require.Equal(t, []string{"not json"}, left)
+}
+
+func TestQueueRedisFailedJobsPaging(t *testing.T) {
+	queue, _ := openTestQueueRedis(t)
+	queue.SetJobOptions("import", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("import", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errors.New("boom")
+	}))
+	queue.SetJobOptions("export", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	queue.AddJobContextHandler("export", JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return errors.New("boom")
+	}))
+
+	for i := 0; i < failedScanPageSize+5; i++ {
+		require.NoError(t, queue.AddJob("import", strconv.Itoa(i)))
+		require.NoError(t, queue.AddJob("export", strconv.Itoa(i)))
+	}
+	for queue.processNextJob(DefaultQueueName) {
+	}
+
+	failedJobs, err := queue.FailedJobs("", 0, 0)
+	require.NoError(t, err)
+	require.Len(t, failedJobs, (failedScanPageSize+5)*2)
+
+	page, err := queue.FailedJobs("", failedScanPageSize*2, 20)
+	require.NoError(t, err)
+	require.Equal(t, failedJobs[failedScanPageSize*2:], page)
+
+	page, err = queue.FailedJobs("import", failedScanPageSize, -1)
+	require.NoError(t, err)
+	require.Len(t, page, 5)
+
+	var buf bytes.Buffer
+	require.NoError(t, queue.ExportFailedJobs(&buf, "export"))
+	require.Equal(t, failedScanPageSize+5, strings.Count(buf.String(), "\n"))
+}
@@ -0,0 +1,121 @@
+package gocommonweb
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultMaxAttempts   = 5
+	defaultBackoffBase   = time.Second * 10
+	defaultBackoffMax    = time.Hour
+	defaultBackoffJitter = 0.2
+)
+
+// BackoffFunc return delay before the next attempt, attempt is
+// the number of the attempt that just failed starting from 1
+type BackoffFunc func(attempt int) time.Duration
+
+// RetryPolicy decide whether and when failed job is retried
+type RetryPolicy struct {
+	// MaxAttempts including the first run, zero means default
+	// and negative means retry forever
+	MaxAttempts int
+
+	// Backoff delay between attempts, nil means default exponential backoff
+	Backoff BackoffFunc
+
+	// NonRetryable errors that fail the job right away, matched using errors.Is.
+	// errors wrapped with PermanentError are never retried either
+	NonRetryable []error
+}
+
+// ExponentialBackoff double base delay on every attempt up to max,
+// jitter is fraction of the delay randomly added or subtracted e.g. 0.2 for +-20%
+func ExponentialBackoff(base time.Duration, max time.Duration, jitter float64) BackoffFunc {
+	return func(attempt int) time.Duration {
+		delay := base
+		for i := 1; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		if jitter > 0 {
+			delta := float64(delay) * jitter
+			delay += time.Duration(delta*2*rand.Float64() - delta)
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		return delay
+	}
+}
+
+// ConstantBackoff always wait the same delay between attempts
+func ConstantBackoff(delay time.Duration) BackoffFunc {
+	return func(_ int) time.Duration {
+		return delay
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// PermanentError wrap error returned by job handler so the job
+// fails without being retried regardless of its retry policy
+func PermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) isRetryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	for _, nonRetryable := range p.NonRetryable {
+		if errors.Is(err, nonRetryable) {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldRetry check whether job that just failed on given attempt needs to be retried
+func (p RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if !p.isRetryable(err) {
+		return false
+	}
+	maxAttempts := p.maxAttempts()
+	return maxAttempts < 0 || attempt < maxAttempts
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return ExponentialBackoff(defaultBackoffBase, defaultBackoffMax, defaultBackoffJitter)(attempt)
+	}
+	return p.Backoff(attempt)
+}
+
+// maxAttemptsDescriptor max attempts as shown in Job descriptor, zero for unlimited
+func (p RetryPolicy) maxAttemptsDescriptor() int {
+	if maxAttempts := p.maxAttempts(); maxAttempts > 0 {
+		return maxAttempts
+	}
+	return 0
+}
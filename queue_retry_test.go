@@ -0,0 +1,41 @@
+package gocommonweb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, time.Second*10, 0)
+	require.Equal(t, time.Second, backoff(1))
+	require.Equal(t, time.Second*2, backoff(2))
+	require.Equal(t, time.Second*8, backoff(4))
+	require.Equal(t, time.Second*10, backoff(5))
+	require.Equal(t, time.Second*10, backoff(100))
+
+	jittered := ExponentialBackoff(time.Second*10, time.Minute, 0.5)
+	for i := 0; i < 100; i++ {
+		delay := jittered(1)
+		require.True(t, delay >= time.Second*5 && delay <= time.Second*15, delay)
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	errInvalidPayload := errors.New("invalid payload")
+	policy := RetryPolicy{MaxAttempts: 3, NonRetryable: []error{errInvalidPayload}}
+
+	errTemporary := errors.New("temporary")
+	require.True(t, policy.shouldRetry(1, errTemporary))
+	require.True(t, policy.shouldRetry(2, errTemporary))
+	require.False(t, policy.shouldRetry(3, errTemporary))
+
+	require.False(t, policy.shouldRetry(1, fmt.Errorf("decode: %w", errInvalidPayload)))
+	require.False(t, policy.shouldRetry(1, PermanentError(errTemporary)))
+
+	require.True(t, RetryPolicy{MaxAttempts: -1}.shouldRetry(1000, errTemporary))
+	require.False(t, RetryPolicy{}.shouldRetry(defaultMaxAttempts, errTemporary))
+}
@@ -0,0 +1,138 @@
+package gocommonweb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStats depth and processing metrics of a job name in a queue
+type JobStats struct {
+	Queue   string `json:"queue"`
+	JobName string `json:"job_name"`
+
+	// Waiting jobs including delayed ones, Processing jobs claimed by
+	// workers of any process and Failed jobs that ran out of attempts
+	Waiting    int64 `json:"waiting"`
+	Processing int64 `json:"processing"`
+	Failed     int64 `json:"failed"`
+
+	// OldestWaiting age of the oldest job due to run, zero when none is due
+	OldestWaiting time.Duration `json:"oldest_waiting"`
+
+	// attempts handled by this process since the queue was created,
+	// latency is the time from a job being due to its attempt start
+	Succeeded      int64         `json:"succeeded"`
+	FailedAttempts int64         `json:"failed_attempts"`
+	LatencyTotal   time.Duration `json:"latency_total"`
+	DurationTotal  time.Duration `json:"duration_total"`
+}
+
+// Attempts count of attempts handled by this process
+func (s JobStats) Attempts() int64 {
+	return s.Succeeded + s.FailedAttempts
+}
+
+// SuccessRate ratio of succeeded attempts, zero when there was none
+func (s JobStats) SuccessRate() float64 {
+	if s.Attempts() == 0 {
+		return 0
+	}
+	return float64(s.Succeeded) / float64(s.Attempts())
+}
+
+// AvgLatency average time from a job being due to its attempt start
+func (s JobStats) AvgLatency() time.Duration {
+	if s.Attempts() == 0 {
+		return 0
+	}
+	return s.LatencyTotal / time.Duration(s.Attempts())
+}
+
+// AvgDuration average run duration of an attempt
+func (s JobStats) AvgDuration() time.Duration {
+	if s.Attempts() == 0 {
+		return 0
+	}
+	return s.DurationTotal / time.Duration(s.Attempts())
+}
+
+type jobStatsKey struct {
+	queue   string
+	jobName string
+}
+
+// jobStatsSet stats being collected keyed by queue and job name
+type jobStatsSet map[jobStatsKey]*JobStats
+
+func (s jobStatsSet) get(queueName string, jobName string) *JobStats {
+	key := jobStatsKey{queue: queueName, jobName: jobName}
+	stats, ok := s[key]
+	if !ok {
+		stats = &JobStats{Queue: queueName, JobName: jobName}
+		s[key] = stats
+	}
+	return stats
+}
+
+func (s jobStatsSet) list() []JobStats {
+	list := make([]JobStats, 0, len(s))
+	for _, stats := range s {
+		list = append(list, *stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Queue != list[j].Queue {
+			return list[i].Queue < list[j].Queue
+		}
+		return list[i].JobName < list[j].JobName
+	})
+	return list
+}
+
+// jobMetrics attempt counters shared by queue implementations
+type jobMetrics struct {
+	metricsMutex sync.Mutex
+	attempts     jobStatsSet
+}
+
+// recordAttempt count finished attempt of a job that was due at dueAt
+func (m *jobMetrics) recordAttempt(queueName string, jobName string, dueAt time.Time, startedAt time.Time, err error) {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	if m.attempts == nil {
+		m.attempts = make(jobStatsSet)
+	}
+
+	stats := m.attempts.get(queueName, jobName)
+	if err == nil {
+		stats.Succeeded++
+	} else {
+		stats.FailedAttempts++
+	}
+	if latency := startedAt.Sub(dueAt); latency > 0 {
+		stats.LatencyTotal += latency
+	}
+	stats.DurationTotal += time.Since(startedAt)
+}
+
+// mergeAttempts add attempt counters to stats collected from queue storage
+func (m *jobMetrics) mergeAttempts(set jobStatsSet) []JobStats {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	for key, attempts := range m.attempts {
+		stats := set.get(key.queue, key.jobName)
+		stats.Succeeded = attempts.Succeeded
+		stats.FailedAttempts = attempts.FailedAttempts
+		stats.LatencyTotal = attempts.LatencyTotal
+		stats.DurationTotal = attempts.DurationTotal
+	}
+	return set.list()
+}
+
+// oldestWaiting age of job due at dueAt
+func oldestWaiting(dueAt time.Time, now time.Time) time.Duration {
+	if dueAt.IsZero() || dueAt.After(now) {
+		return 0
+	}
+	return now.Sub(dueAt)
+}
@@ -0,0 +1,118 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// job states reported by GetJobStatus
+const (
+	JobWaiting    = statusWaiting
+	JobProcessing = statusProcessing
+	JobComplete   = statusComplete
+	JobFailed     = statusFailed
+)
+
+// ErrJobNotFound job is unknown, it was cancelled or removed after it finished
+var ErrJobNotFound = errors.New("job not found")
+
+// JobStatus state, progress and outcome of a job
+type JobStatus struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Attempt int    `json:"attempt"`
+
+	// Progress percentage 0-100 and message last reported by the running attempt
+	Progress        int    `json:"progress"`
+	ProgressMessage string `json:"progress_message"`
+
+	// Result payload of completed job, Error of the last failed attempt
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+// ReportProgress store progress percentage and message of the running job,
+// pct is clamped to 0-100. it fails once the attempt timed out
+func (j *Job) ReportProgress(pct int, message string) error {
+	if pct < 0 {
+		pct = 0
+	} else if pct > 100 {
+		pct = 100
+	}
+	if j.progressReporter == nil {
+		return nil
+	}
+	return j.progressReporter(pct, message)
+}
+
+// SetResult set result payload stored with the job once the attempt succeeds,
+// result of an attempt that timed out is dropped
+func (j *Job) SetResult(result string) {
+	j.result = result
+}
+
+// JobResultHandlerFunc job handler returning result payload of the job
+type JobResultHandlerFunc func(ctx context.Context, job *Job) (string, error)
+
+func (f JobResultHandlerFunc) HandleJob(ctx context.Context, job *Job) error {
+	result, err := f(ctx, job)
+	if err == nil {
+		job.SetResult(result)
+	}
+	return err
+}
+
+// jobStatusEvents publisher of job state changes shared by queue implementations
+type jobStatusEvents struct {
+	statusMutex sync.Mutex
+	statusEvent Event
+	statusTopic string
+}
+
+// PublishJobStatus publish JobStatus as json to eventName every time a job
+// starts, reports progress, completes, is retried or fails
+func (p *jobStatusEvents) PublishJobStatus(event Event, eventName string) {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+	p.statusEvent = event
+	p.statusTopic = eventName
+}
+
+func (p *jobStatusEvents) publishStatus(status JobStatus) {
+	p.statusMutex.Lock()
+	event, eventName := p.statusEvent, p.statusTopic
+	p.statusMutex.Unlock()
+	if event == nil {
+		return
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	if err := event.Publish(eventName, string(payload)); err != nil {
+		logrus.Errorf("[queue] publish job %s - %s status: %s", status.Name, status.ID, err)
+	}
+}
+
+// publishCurrentStatus read status of job with id from queue storage and publish it
+func (p *jobStatusEvents) publishCurrentStatus(id string, getStatus func(id string) (*JobStatus, error)) {
+	p.statusMutex.Lock()
+	enabled := p.statusEvent != nil
+	p.statusMutex.Unlock()
+	if !enabled {
+		return
+	}
+
+	status, err := getStatus(id)
+	if err != nil {
+		logrus.Errorf("[queue] get job %s status: %s", id, err)
+		return
+	}
+	p.publishStatus(*status)
+}
@@ -4,9 +4,19 @@ import "time"
 
 type ScheduleHandler func(execTime time.Time, jobName string, cronSpec string)
 
+// Scheduler run handlers on cron schedule, cron spec has 5 fields or 6 with
+// seconds first and is evaluated in local time zone unless it is prefixed by
+// CRON_TZ=<zone>. on daylight saving changes a run skipped by the jump forward
+// runs right after it and a run in the repeated hour runs once
 type Scheduler interface {
 	ScheduleJob(jobName string, cronSpec string, handler ScheduleHandler) error
 	ScheduleJobToQueue(jobName string, cronSpec string, queue Queue) error
+
+	// AddJob schedule job or replace schedule of job with the same name,
+	// it can be called while the scheduler is running
+	AddJob(jobName string, cronSpec string, handler ScheduleHandler) error
+	RemoveJob(jobName string) error
+
 	Start()
 	Stop()
 }
@@ -0,0 +1,113 @@
+package gocommonweb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// cron specs have 5 fields, minute hour day-of-month month day-of-week, or 6 fields
+// with seconds first. a spec can be prefixed by CRON_TZ=<zone> to evaluate it in
+// that IANA time zone, e.g. "CRON_TZ=Asia/Jakarta 0 9 * * *".
+//
+// specs match wall clock time of their zone, on daylight saving changes:
+//   - a run whose time is skipped when clocks jump forward runs once at the first
+//     instant after the jump, e.g. 02:30 runs at 03:00 when 02:00 jumps to 03:00
+//   - a run whose time repeats when clocks fall back runs once on the first
+//     occurrence, runs within the repeated hour are not repeated either
+//   - "@every <duration>" counts elapsed time and is not affected by the change
+
+const cronTZPrefix = "CRON_TZ="
+
+var cronSecondsParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// cronSchedule schedule matching wall clock time of location
+type cronSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+// parseCronSpec parse cron spec, spec without CRON_TZ prefix is evaluated in location
+func parseCronSpec(spec string, location *time.Location) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, cronTZPrefix) {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("missing cron spec after %s", spec)
+		}
+		zone, err := time.LoadLocation(spec[len(cronTZPrefix):i])
+		if err != nil {
+			return nil, err
+		}
+		location = zone
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	var schedule cron.Schedule
+	var err error
+	if len(strings.Fields(spec)) == 6 {
+		schedule, err = cronSecondsParser.Parse(spec)
+	} else {
+		schedule, err = cron.ParseStandard(spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cronSchedule{schedule: schedule, location: location}, nil
+}
+
+// Next first run after t in the zone of the schedule, zero time when there is none
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	if _, ok := s.schedule.(cron.ConstantDelaySchedule); ok {
+		return s.schedule.Next(t).In(s.location)
+	}
+
+	// the spec is matched against wall clock time, represented in UTC
+	// where every day has 24 hours, then mapped back to an instant
+	wall := wallClock(t.In(s.location))
+	for {
+		wall = s.schedule.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		if next := s.instant(wall); next.After(t) {
+			return next
+		}
+	}
+}
+
+// instant earliest instant showing wall clock time in the location, the first
+// instant after the gap when wall time is skipped by daylight saving change
+func (s *cronSchedule) instant(wall time.Time) time.Time {
+	// offsets in effect around wall time, the same one most of the time
+	_, larger := wall.Add(-time.Hour * 24).In(s.location).Zone()
+	_, smaller := wall.Add(time.Hour * 24).In(s.location).Zone()
+	if larger < smaller {
+		larger, smaller = smaller, larger
+	}
+	earlier := wall.Add(-time.Duration(larger) * time.Second)
+	later := wall.Add(-time.Duration(smaller) * time.Second)
+	for _, candidate := range []time.Time{earlier, later} {
+		if wallClock(candidate.In(s.location)).Equal(wall) {
+			return candidate.In(s.location)
+		}
+	}
+
+	// wall time is skipped, find the first second shown after it
+	for later.Sub(earlier) > time.Second {
+		middle := earlier.Add(later.Sub(earlier) / 2).Truncate(time.Second)
+		if wallClock(middle.In(s.location)).Before(wall) {
+			earlier = middle
+		} else {
+			later = middle
+		}
+	}
+	return later.In(s.location)
+}
+
+// wallClock wall clock time of t as UTC time
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,81 @@
+package gocommonweb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
+
+// nextRuns first count runs of spec after from
+func nextRuns(t *testing.T, spec string, from time.Time, count int) []string {
+	schedule, err := parseCronSpec(spec, time.UTC)
+	require.NoError(t, err)
+	var runs []string
+	for i := 0; i < count; i++ {
+		from = schedule.Next(from)
+		runs = append(runs, from.Format(time.RFC3339))
+	}
+	return runs
+}
+
+func TestParseCronSpec(t *testing.T) {
+	from := time.Date(2021, 6, 1, 12, 0, 7, 0, time.UTC)
+	require.Equal(t, []string{"2021-06-01T12:00:15Z", "2021-06-01T12:00:30Z"}, nextRuns(t, "*/15 * * * * *", from, 2))
+	require.Equal(t, []string{"2021-06-01T12:01:00Z"}, nextRuns(t, "* * * * *", from, 1))
+	require.Equal(t, []string{"2021-06-02T09:00:00+07:00"}, nextRuns(t, "CRON_TZ=Asia/Jakarta 0 9 * * *", from, 1))
+
+	schedule, err := parseCronSpec("0 9 * * *", mustLoadLocation(t, "Asia/Jakarta"))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 6, 2, 2, 0, 0, 0, time.UTC), schedule.Next(from).UTC())
+
+	for _, spec := range []string{"CRON_TZ=Mars/Olympus 0 9 * * *", "CRON_TZ=UTC", "0 9 * *", "61 * * * * *"} {
+		_, err := parseCronSpec(spec, time.UTC)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestCronScheduleDaylightSaving(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// 2021-03-14 02:00 EST jumps to 03:00 EDT, skipped runs run once at 03:00
+	springForward := time.Date(2021, 3, 14, 1, 45, 0, 0, newYork)
+	require.Equal(t, []string{
+		"2021-03-14T03:00:00-04:00",
+		"2021-03-15T02:30:00-04:00",
+	}, nextRuns(t, "CRON_TZ=America/New_York 30 2 * * *", springForward, 2))
+	require.Equal(t, []string{
+		"2021-03-14T03:00:00-04:00",
+		"2021-03-14T03:30:00-04:00",
+	}, nextRuns(t, "CRON_TZ=America/New_York */30 * * * *", springForward, 2))
+
+	// 2021-11-07 02:00 EDT falls back to 01:00 EST, repeated hour runs once
+	fallBack := time.Date(2021, 11, 7, 0, 45, 0, 0, newYork)
+	require.Equal(t, []string{
+		"2021-11-07T01:30:00-04:00",
+		"2021-11-08T01:30:00-05:00",
+	}, nextRuns(t, "CRON_TZ=America/New_York 30 1 * * *", fallBack, 2))
+	require.Equal(t, []string{
+		"2021-11-07T01:00:00-04:00",
+		"2021-11-07T01:30:00-04:00",
+		"2021-11-07T02:00:00-05:00",
+	}, nextRuns(t, "CRON_TZ=America/New_York */30 * * * *", fallBack, 3))
+
+	// clock that already fell back continues after the repeated hour
+	secondPass := time.Date(2021, 11, 7, 6, 10, 0, 0, time.UTC)
+	require.Equal(t, "01:10:00 EST", secondPass.In(newYork).Format("15:04:05 MST"))
+	require.Equal(t, []string{"2021-11-07T02:00:00-05:00"}, nextRuns(t, "CRON_TZ=America/New_York */30 * * * *", secondPass, 1))
+
+	// elapsed time intervals ignore the change
+	require.Equal(t, []string{
+		"2021-11-07T01:15:00-04:00",
+		"2021-11-07T01:45:00-04:00",
+		"2021-11-07T01:15:00-05:00",
+	}, nextRuns(t, "CRON_TZ=America/New_York @every 30m", fallBack, 3))
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -16,14 +16,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type byShortestNextExecution []*scheduleEntry
-
-func (s byShortestNextExecution) Len() int      { return len(s) }
-func (s byShortestNextExecution) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s byShortestNextExecution) Less(i, j int) bool {
-	return s[i].nextExecution.Before(s[j].nextExecution)
-}
-
 type scheduleEntry struct {
 	jobName       string
 	cronSpec      string
@@ -32,10 +24,16 @@ type scheduleEntry struct {
 }
 
 type ScheduleSafeImpl struct {
+	// mutex guards running state, handlers and entries, jobs can be
+	// added and removed from other goroutines while running. it is
+	// never held across redis calls
+	mutex           sync.Mutex
 	running         bool
 	handlers        map[string]ScheduleHandler
 	scheduleEntries []*scheduleEntry
 	stopChan        chan bool
+	wake            chan struct{}
+	clock           func() time.Time
 	rSync           *redsync.Redsync
 	redisClient     *redis.Client
 }
@@ -69,7 +67,8 @@ func NewScheduler(redisClient ...*redis.Client) Scheduler {
 	return &ScheduleSafeImpl{
 		running:     false,
 		handlers:    make(map[string]ScheduleHandler),
-		stopChan:    make(chan bool),
+		wake:        make(chan struct{}, 1),
+		clock:       time.Now,
 		rSync:       redSync,
 		redisClient: redisClient[0],
 	}
@@ -81,12 +80,13 @@ func (s *ScheduleSafeImpl) ScheduleJobToQueue(jobName string, cronSpec string, q
 	})
 }
 
+// ScheduleJob same as AddJob
 func (s *ScheduleSafeImpl) ScheduleJob(jobName string, cronSpec string, handler ScheduleHandler) error {
-	if s.running {
-		return fmt.Errorf("cannot add new job while scheduler already running")
-	}
+	return s.AddJob(jobName, cronSpec, handler)
+}
 
-	schedule, err := cron.ParseStandard(cronSpec)
+func (s *ScheduleSafeImpl) AddJob(jobName string, cronSpec string, handler ScheduleHandler) error {
+	schedule, err := parseCronSpec(cronSpec, time.Local)
 	if err != nil {
 		return err
 	}
@@ -94,67 +94,180 @@ func (s *ScheduleSafeImpl) ScheduleJob(jobName string, cronSpec string, handler
 	entry := scheduleEntry{
 		jobName:       jobName,
 		cronSpec:      cronSpec,
-		nextExecution: schedule.Next(now()),
+		nextExecution: schedule.Next(s.now()),
 		cronSchedule:  schedule,
 	}
+	if nextExec, err := s.retrieveNextExecutionTime(jobName, cronSpec); err == nil {
+		entry.nextExecution = time.Unix(nextExec, 0)
+	} else if err := s.updateNextExecutionTime(&entry); err != nil {
+		return err
+	}
 
+	s.mutex.Lock()
+	s.removeEntryLocked(jobName)
 	s.scheduleEntries = append(s.scheduleEntries, &entry)
 	s.handlers[jobName] = handler
-	if nextExec, err := s.retrieveNextExecutionTime(jobName, cronSpec); err == nil {
-		entry.nextExecution = time.Unix(nextExec, 0)
-	} else {
-		return s.updateNextExecutionTime(&entry)
+	s.mutex.Unlock()
+	s.wakeRunLoop()
+	return nil
+}
+
+// RemoveJob stop scheduling job, its next execution time is removed from redis
+func (s *ScheduleSafeImpl) RemoveJob(jobName string) error {
+	s.mutex.Lock()
+	entry := s.removeEntryLocked(jobName)
+	delete(s.handlers, jobName)
+	s.mutex.Unlock()
+	if entry == nil {
+		return fmt.Errorf("job %s is not scheduled", jobName)
+	}
+
+	s.wakeRunLoop()
+	key := getSchedulerKey(entry.jobName, entry.cronSpec)
+	return s.redisClient.Del(context.Background(), key).Err()
+}
+
+// removeEntryLocked remove entry of job from the schedule and return it
+func (s *ScheduleSafeImpl) removeEntryLocked(jobName string) *scheduleEntry {
+	for i, entry := range s.scheduleEntries {
+		if entry.jobName == jobName {
+			s.scheduleEntries = append(s.scheduleEntries[:i], s.scheduleEntries[i+1:]...)
+			return entry
+		}
 	}
 	return nil
 }
 
+func (s *ScheduleSafeImpl) wakeRunLoop() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
 func (s *ScheduleSafeImpl) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if s.running {
 		s.running = false
-		s.stopChan <- true
+		close(s.stopChan)
 	}
 }
 
+// Start run the scheduler, it waits for jobs to be added when there is none
 func (s *ScheduleSafeImpl) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if s.running {
 		return
 	}
 	s.running = true
-	go s.run()
+	s.stopChan = make(chan bool)
+	go s.run(s.stopChan)
 }
 
-func (s *ScheduleSafeImpl) run() {
+func (s *ScheduleSafeImpl) run(stopChan chan bool) {
 	for {
-		if len(s.scheduleEntries) <= 0 {
-			s.running = false
-			return
+		// without entries only a new job or stop ends the wait
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if duration, ok := s.nextExecutionDelay(); ok {
+			timer = time.NewTimer(duration)
+			timeout = timer.C
 		}
 
-		s.refreshScheduleEntries()
-		sort.Sort(byShortestNextExecution(s.scheduleEntries))
-		duration := s.scheduleEntries[0].nextExecution.Sub(now())
-		timer := time.NewTimer(duration)
-
 		select {
-		case <-timer.C:
-			now := now()
-			for _, entry := range s.scheduleEntries {
-				if entry.nextExecution.Unix() <= now.Unix() {
-					if handler, ok := s.handlers[entry.jobName]; ok {
-						if err := s.lock(entry); err == nil {
-							go handler(now, entry.jobName, entry.cronSpec)
-							entry.nextExecution = entry.cronSchedule.Next(now)
-							_ = s.updateNextExecutionTime(entry)
-						}
-					}
-				} else {
-					break
-				}
-			}
-		case <-s.stopChan:
+		case <-timeout:
+			s.executeDueJobs()
+		case <-s.wake:
+		case <-stopChan:
+			stopTimer(timer)
 			logrus.Debug("scheduler stopped intentionally")
 			return
 		}
+		stopTimer(timer)
+	}
+}
+
+// entrySnapshot copy of a schedule entry and its handler taken under the
+// mutex, redis is called with the copy so the mutex is not held meanwhile
+type entrySnapshot struct {
+	scheduleEntry
+	entry   *scheduleEntry
+	handler ScheduleHandler
+}
+
+func (s *ScheduleSafeImpl) snapshotEntries() []entrySnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshots := make([]entrySnapshot, 0, len(s.scheduleEntries))
+	for _, entry := range s.scheduleEntries {
+		snapshots = append(snapshots, entrySnapshot{
+			scheduleEntry: *entry,
+			entry:         entry,
+			handler:       s.handlers[entry.jobName],
+		})
+	}
+	return snapshots
+}
+
+// setNextExecution store next execution time of entry, it returns
+// false when the entry was removed or replaced in the meantime
+func (s *ScheduleSafeImpl) setNextExecution(entry *scheduleEntry, nextExecution time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, current := range s.scheduleEntries {
+		if current == entry {
+			entry.nextExecution = nextExecution
+			return true
+		}
+	}
+	return false
+}
+
+// nextExecutionDelay refresh entries from redis and return how long until
+// the earliest one is due, false when there is no job to wait for
+func (s *ScheduleSafeImpl) nextExecutionDelay() (time.Duration, bool) {
+	snapshots := s.snapshotEntries()
+	if len(snapshots) <= 0 {
+		return 0, false
+	}
+
+	var earliest time.Time
+	for i, snapshot := range snapshots {
+		// another instance may have run the job and stored its next execution
+		if nextExec, err := s.retrieveNextExecutionTime(snapshot.jobName, snapshot.cronSpec); err == nil {
+			snapshot.nextExecution = time.Unix(nextExec, 0)
+			s.setNextExecution(snapshot.entry, snapshot.nextExecution)
+		}
+		if i == 0 || snapshot.nextExecution.Before(earliest) {
+			earliest = snapshot.nextExecution
+		}
+	}
+	return earliest.Sub(s.now()), true
+}
+
+func (s *ScheduleSafeImpl) executeDueJobs() {
+	now := s.now()
+	for _, snapshot := range s.snapshotEntries() {
+		if snapshot.nextExecution.Unix() > now.Unix() || snapshot.handler == nil {
+			continue
+		}
+		if err := s.lock(&snapshot.scheduleEntry); err != nil {
+			continue
+		}
+		snapshot.nextExecution = snapshot.cronSchedule.Next(now)
+		if !s.setNextExecution(snapshot.entry, snapshot.nextExecution) {
+			continue
+		}
+		go snapshot.handler(now, snapshot.jobName, snapshot.cronSpec)
+		_ = s.updateNextExecutionTime(&snapshot.scheduleEntry)
+
+		// job removed meanwhile must not leave its next execution behind
+		if !s.setNextExecution(snapshot.entry, snapshot.nextExecution) {
+			key := getSchedulerKey(snapshot.jobName, snapshot.cronSpec)
+			_ = s.redisClient.Del(context.Background(), key).Err()
+		}
 	}
 }
 
@@ -171,24 +284,14 @@ func (s *ScheduleSafeImpl) retrieveNextExecutionTime(jobName string, cronSpec st
 	}
 }
 
-func (s *ScheduleSafeImpl) refreshScheduleEntries() {
-	for _, entry := range s.scheduleEntries {
-		key := getSchedulerKey(entry.jobName, entry.cronSpec)
-		// TODO optimize using redis hash map
-		if res, err := s.redisClient.Get(context.Background(), key).Result(); err == nil {
-			entry.nextExecution = time.Unix(stringToInt64(res), 0)
-		}
-	}
-}
-
 func (s *ScheduleSafeImpl) updateNextExecutionTime(entry *scheduleEntry) error {
 	key := getSchedulerKey(entry.jobName, entry.cronSpec)
-	duration := entry.nextExecution.Sub(now())
+	duration := entry.nextExecution.Sub(s.now())
 	return s.redisClient.Set(context.Background(), key, entry.nextExecution.Unix(), duration).Err()
 }
 
 func (s *ScheduleSafeImpl) lock(entry *scheduleEntry) error {
-	now := time.Unix(time.Now().Unix(), 0)
+	now := s.now()
 	duration := entry.cronSchedule.Next(now).Sub(now)
 	duration = duration - time.Duration(float64(duration)*lockDurationOffsetFactor)
 
@@ -207,8 +310,15 @@ func getMutexKey(jobName string, cronSpec string) string {
 	return fmt.Sprintf("handlerMutex:%s-%s", jobName, cronSpecEnc)
 }
 
-func now() time.Time {
-	return time.Unix(time.Now().Unix(), 0)
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// now current time of the scheduler clock in whole seconds
+func (s *ScheduleSafeImpl) now() time.Time {
+	return time.Unix(s.clock().Unix(), 0)
 }
 
 const lockDurationOffsetFactor = 0.1
@@ -0,0 +1,128 @@
+package gocommonweb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerAddAndRemoveWhileRunning(t *testing.T) {
+	client := openTestRedis(t)
+	scheduler := NewScheduler(client)
+
+	// started without jobs it waits for one to be added
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	executed := make(chan string, 10)
+	handler := func(execTime time.Time, jobName string, cronSpec string) {
+		executed <- jobName
+	}
+	require.NoError(t, scheduler.AddJob("tick", "* * * * * *", handler))
+	select {
+	case jobName := <-executed:
+		require.Equal(t, "tick", jobName)
+	case <-time.After(time.Second * 3):
+		t.Fatal("job added while running not executed")
+	}
+
+	require.NoError(t, scheduler.RemoveJob("tick"))
+	require.Error(t, scheduler.RemoveJob("tick"))
+	require.Eventually(t, func() bool {
+		keys, err := client.Keys(context.Background(), "scheduler:*").Result()
+		return err == nil && len(keys) == 0
+	}, time.Second, time.Millisecond*10, "next execution of removed job left in redis")
+	for len(executed) > 0 {
+		<-executed
+	}
+	select {
+	case <-executed:
+		t.Fatal("removed job executed")
+	case <-time.After(time.Millisecond * 1500):
+	}
+
+	// jobs are added and removed concurrently with the run loop
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jobName := fmt.Sprintf("job-%d", i)
+			require.NoError(t, scheduler.AddJob(jobName, "0 0 1 1 *", handler))
+			require.NoError(t, scheduler.RemoveJob(jobName))
+		}(i)
+	}
+	wg.Wait()
+
+	require.NoError(t, scheduler.AddJob("tock", "* * * * * *", handler))
+	select {
+	case jobName := <-executed:
+		require.Equal(t, "tock", jobName)
+	case <-time.After(time.Second * 3):
+		t.Fatal("job added again not executed")
+	}
+}
+
+func TestSchedulerClock(t *testing.T) {
+	client := openTestRedis(t)
+	scheduler := NewScheduler(client).(*ScheduleSafeImpl)
+	clock := time.Date(2021, 3, 14, 6, 59, 59, 0, time.UTC)
+	scheduler.clock = func() time.Time { return clock }
+
+	executed := make(chan string, 10)
+	handler := func(execTime time.Time, jobName string, cronSpec string) {
+		executed <- jobName + " " + execTime.UTC().Format(time.RFC3339)
+	}
+	nextExecuted := func() string {
+		select {
+		case execution := <-executed:
+			return execution
+		case <-time.After(time.Second * 5):
+			t.Fatal("due job not executed")
+			return ""
+		}
+	}
+
+	// 02:30 is skipped by the jump to daylight saving time, it runs at 03:00 EDT
+	backupSpec := "CRON_TZ=America/New_York 30 2 * * *"
+	require.NoError(t, scheduler.AddJob("backup", backupSpec, handler))
+	require.NoError(t, scheduler.AddJob("tick", "CRON_TZ=America/New_York */15 * * * * *", handler))
+
+	delay, ok := scheduler.nextExecutionDelay()
+	require.True(t, ok)
+	require.Equal(t, time.Second, delay)
+	nextExec, err := scheduler.retrieveNextExecutionTime("backup", backupSpec)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 3, 14, 7, 0, 0, 0, time.UTC).Unix(), nextExec)
+
+	clock = clock.Add(time.Second)
+	scheduler.executeDueJobs()
+	require.ElementsMatch(t, []string{
+		"backup 2021-03-14T07:00:00Z",
+		"tick 2021-03-14T07:00:00Z",
+	}, []string{nextExecuted(), nextExecuted()})
+
+	delay, ok = scheduler.nextExecutionDelay()
+	require.True(t, ok)
+	require.Equal(t, time.Second*15, delay)
+	nextExec, err = scheduler.retrieveNextExecutionTime("backup", backupSpec)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 3, 15, 6, 30, 0, 0, time.UTC).Unix(), nextExec)
+
+	// job that is not due yet is not executed
+	clock = clock.Add(time.Second * 14)
+	scheduler.executeDueJobs()
+	require.Len(t, executed, 0)
+
+	// execution lock expires in redis time, release it for the fake clock
+	locks, err := client.Keys(context.Background(), "handlerMutex:*").Result()
+	require.NoError(t, err)
+	require.NoError(t, client.Del(context.Background(), locks...).Err())
+	clock = clock.Add(time.Second)
+	scheduler.executeDueJobs()
+	require.Equal(t, "tick 2021-03-14T07:00:15Z", nextExecuted())
+}
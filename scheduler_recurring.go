@@ -0,0 +1,70 @@
+package gocommonweb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRecurringJobNotFound recurring job is unknown or was removed
+var ErrRecurringJobNotFound = errors.New("recurring job not found")
+
+// RecurringJob job enqueued onto a Queue every time its cron spec fires
+type RecurringJob struct {
+	ID       string `json:"id"`
+	CronSpec string `json:"cron_spec"`
+	JobName  string `json:"job_name"`
+	Payload  string `json:"payload"`
+	Enabled  bool   `json:"enabled"`
+
+	// Timezone IANA name the cron spec is evaluated in, empty means UTC.
+	// CRON_TZ prefix of the spec takes precedence
+	Timezone string `json:"timezone"`
+
+	// NextRunAt is empty while the job is disabled
+	NextRunAt *time.Time `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at"`
+}
+
+// RecurringJobs registry of recurring jobs that can be changed while running,
+// changes made by one instance are picked up by every other instance
+type RecurringJobs interface {
+	Add(job RecurringJob) (string, error)
+
+	// Update replace cron spec, job name, payload, enabled flag
+	// and timezone of the job with the same ID
+	Update(job RecurringJob) error
+	SetEnabled(id string, enabled bool) error
+	Remove(id string) error
+	Get(id string) (*RecurringJob, error)
+	List() ([]RecurringJob, error)
+
+	// Start enqueue due jobs until Stop is called
+	Start()
+	Stop()
+}
+
+// recurringSchedule parse cron spec of job evaluated in its timezone
+func recurringSchedule(cronSpec string, timezone string) (*cronSchedule, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	return parseCronSpec(cronSpec, location)
+}
+
+// nextRun validate the job and return first time after t it fires, nil when it is disabled
+func (j RecurringJob) nextRun(t time.Time) (*time.Time, error) {
+	if j.JobName == "" {
+		return nil, fmt.Errorf("recurring job name is empty")
+	}
+	schedule, err := recurringSchedule(j.CronSpec, j.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if !j.Enabled {
+		return nil, nil
+	}
+	next := schedule.Next(t).UTC()
+	return &next, nil
+}
@@ -0,0 +1,384 @@
+package gocommonweb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRecurringPollInterval = time.Second * 10
+	recurringBatchSize           = 100
+)
+
+// times of recurring jobs are stored in UTC
+
+type recurringJob struct {
+	gorm.Model
+	CronSpec  string
+	JobName   string
+	Payload   string
+	Enabled   bool `gorm:"index:idx_recurring_jobs_due,priority:1"`
+	Timezone  string
+	NextRunAt *time.Time `gorm:"index:idx_recurring_jobs_due,priority:2"`
+	LastRunAt *time.Time
+
+	// Version is incremented by every change and firing, an instance only
+	// fires the job when the version it read is still current
+	Version int
+}
+
+// RecurringJobsDBOptions options of database recurring jobs registry
+type RecurringJobsDBOptions struct {
+	// PollInterval how often changes made by other instances are looked for
+	// when no job is due earlier, default 10 seconds
+	PollInterval time.Duration
+}
+
+// transactionalQueueDB queue whose jobs may be stored in the registry database
+type transactionalQueueDB interface {
+	TransactionalQueue
+	storedIn(db *gorm.DB) bool
+}
+
+type recurringJobsDB struct {
+	db    *gorm.DB
+	queue Queue
+
+	// txQueue set when queue stores its jobs in the registry database,
+	// firing and enqueue of the job are then committed together
+	txQueue        TransactionalQueue
+	options        RecurringJobsDBOptions
+	startMutex     sync.Mutex
+	running        bool
+	stopChan       chan struct{}
+	wake           chan struct{}
+	clock          func() time.Time
+	loopsWaitGroup sync.WaitGroup
+}
+
+// NewRecurringJobsDB create recurring jobs registry stored in database,
+// every firing enqueues the job onto queue
+func NewRecurringJobsDB(db *gorm.DB, queue Queue) (RecurringJobs, error) {
+	return NewRecurringJobsDBWithOptions(db, queue, RecurringJobsDBOptions{})
+}
+
+// NewRecurringJobsDBWithOptions create recurring jobs registry stored in database
+func NewRecurringJobsDBWithOptions(db *gorm.DB, queue Queue, options RecurringJobsDBOptions) (RecurringJobs, error) {
+	if err := db.AutoMigrate(&recurringJob{}); err != nil {
+		return nil, err
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultRecurringPollInterval
+	}
+	r := &recurringJobsDB{
+		db:      db,
+		queue:   queue,
+		options: options,
+		wake:    make(chan struct{}, 1),
+		clock:   time.Now,
+	}
+	if txQueue, ok := queue.(transactionalQueueDB); ok && txQueue.storedIn(db) {
+		r.txQueue = txQueue
+	}
+	return r, nil
+}
+
+func (r *recurringJobsDB) Add(job RecurringJob) (string, error) {
+	nextRunAt, err := job.nextRun(r.clock())
+	if err != nil {
+		return "", err
+	}
+
+	row := recurringJob{
+		CronSpec:  job.CronSpec,
+		JobName:   job.JobName,
+		Payload:   job.Payload,
+		Enabled:   job.Enabled,
+		Timezone:  job.Timezone,
+		NextRunAt: nextRunAt,
+	}
+	if err := r.db.Create(&row).Error; err != nil {
+		return "", err
+	}
+	r.wakeLoop()
+	return formatJobID(row.ID), nil
+}
+
+func (r *recurringJobsDB) Update(job RecurringJob) error {
+	id, err := parseJobID(job.ID)
+	if err != nil {
+		return err
+	}
+	nextRunAt, err := job.nextRun(r.clock())
+	if err != nil {
+		return err
+	}
+
+	return r.update(id, map[string]interface{}{
+		"cron_spec":   job.CronSpec,
+		"job_name":    job.JobName,
+		"payload":     job.Payload,
+		"enabled":     job.Enabled,
+		"timezone":    job.Timezone,
+		"next_run_at": nextRunAt,
+	})
+}
+
+// SetEnabled enable or disable the job, enabled job fires next time its cron
+// spec matches, firings missed while it was disabled are skipped
+func (r *recurringJobsDB) SetEnabled(id string, enabled bool) error {
+	job, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	job.Enabled = enabled
+	nextRunAt, err := job.nextRun(r.clock())
+	if err != nil {
+		return err
+	}
+
+	rowID, _ := parseJobID(id)
+	return r.update(rowID, map[string]interface{}{
+		"enabled":     enabled,
+		"next_run_at": nextRunAt,
+	})
+}
+
+func (r *recurringJobsDB) update(id uint, updates map[string]interface{}) error {
+	updates["version"] = gorm.Expr("version + 1")
+	res := r.db.Model(&recurringJob{}).Where("id = ?", id).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecurringJobNotFound
+	}
+	r.wakeLoop()
+	return nil
+}
+
+func (r *recurringJobsDB) Remove(id string) error {
+	rowID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+	res := r.db.Delete(&recurringJob{}, rowID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecurringJobNotFound
+	}
+	return nil
+}
+
+func (r *recurringJobsDB) Get(id string) (*RecurringJob, error) {
+	rowID, err := parseJobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var row recurringJob
+	err = r.db.First(&row, rowID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRecurringJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := row.descriptor()
+	return &job, nil
+}
+
+func (r *recurringJobsDB) List() ([]RecurringJob, error) {
+	var rows []recurringJob
+	if err := r.db.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	jobs := make([]RecurringJob, 0, len(rows))
+	for _, row := range rows {
+		jobs = append(jobs, row.descriptor())
+	}
+	return jobs, nil
+}
+
+func (r *recurringJobsDB) Start() {
+	r.startMutex.Lock()
+	defer r.startMutex.Unlock()
+	if r.running {
+		return
+	}
+	r.running = true
+	r.stopChan = make(chan struct{})
+	r.loopsWaitGroup.Add(1)
+	go r.run(r.stopChan)
+	logrus.Info("[recurring] scheduler running...")
+}
+
+func (r *recurringJobsDB) Stop() {
+	r.startMutex.Lock()
+	if !r.running {
+		r.startMutex.Unlock()
+		return
+	}
+	r.running = false
+	close(r.stopChan)
+	r.startMutex.Unlock()
+	r.loopsWaitGroup.Wait()
+}
+
+// run enqueue due jobs then sleep until the next job is due, a change made
+// in this process wakes it right away, other processes' within PollInterval
+func (r *recurringJobsDB) run(stopChan chan struct{}) {
+	defer r.loopsWaitGroup.Done()
+	for {
+		delay := r.options.PollInterval
+		now := r.clock()
+		nextRunAt, err := r.fireDueJobs(now)
+		if err != nil {
+			logrus.Errorf("[recurring] fire due jobs: %s", err)
+		} else if nextRunAt != nil {
+			if untilNext := nextRunAt.Sub(now); untilNext < delay {
+				delay = untilNext
+			}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.wake:
+			timer.Stop()
+		case <-stopChan:
+			timer.Stop()
+			logrus.Info("[recurring] scheduler stopped")
+			return
+		}
+	}
+}
+
+func (r *recurringJobsDB) wakeLoop() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fireDueJobs enqueue every job due at now and return when the next job is due.
+// a job that was due several times, e.g. while every instance was down, fires once.
+// job that fails to fire is logged and skipped for the rest of the pass so it
+// doesn't hold back other due jobs, it is retried on the next pass
+func (r *recurringJobsDB) fireDueJobs(now time.Time) (*time.Time, error) {
+	now = now.UTC()
+	var skipped []uint
+	for {
+		var due []recurringJob
+		query := r.db.Where("enabled = ? AND next_run_at <= ?", true, now)
+		if len(skipped) > 0 {
+			query = query.Where("id NOT IN ?", skipped)
+		}
+		err := query.
+			Order("next_run_at").
+			Limit(recurringBatchSize).
+			Find(&due).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range due {
+			if err := r.fire(row, now); err != nil {
+				logrus.Errorf("[recurring] fire job %s - %d: %s", row.JobName, row.ID, err)
+				skipped = append(skipped, row.ID)
+			}
+		}
+		if len(due) < recurringBatchSize {
+			break
+		}
+	}
+
+	var next recurringJob
+	err := r.db.
+		Where("enabled = ? AND next_run_at IS NOT NULL", true).
+		Order("next_run_at").
+		Limit(1).
+		Find(&next).Error
+	if err != nil {
+		return nil, err
+	}
+	return next.NextRunAt, nil
+}
+
+// fire advance job to its next run and enqueue it, only the instance whose
+// update wins enqueues the job so it is enqueued once per firing. with a
+// queue in the same database both are committed in one transaction, otherwise
+// the job is made due again when enqueue fails so the next pass retries it
+func (r *recurringJobsDB) fire(row recurringJob, now time.Time) error {
+	job := row.descriptor()
+	nextRunAt, specErr := job.nextRun(now)
+	if specErr != nil {
+		// spec was changed outside of the registry, stop firing the job
+		logrus.Errorf("[recurring] job %s - %d: %s", row.JobName, row.ID, specErr)
+		nextRunAt = nil
+	}
+
+	fired := false
+	advance := func(tx *gorm.DB) error {
+		res := tx.Model(&recurringJob{}).
+			Where("id = ? AND version = ?", row.ID, row.Version).
+			Updates(map[string]interface{}{
+				"next_run_at": nextRunAt,
+				"last_run_at": now,
+				"version":     gorm.Expr("version + 1"),
+			})
+		fired = res.Error == nil && res.RowsAffected == 1 && specErr == nil
+		return res.Error
+	}
+
+	if r.txQueue != nil {
+		err := r.db.Transaction(func(tx *gorm.DB) error {
+			if err := advance(tx); err != nil || !fired {
+				return err
+			}
+			return r.txQueue.AddJobTx(tx, row.JobName, row.Payload)
+		})
+		if err == nil && fired {
+			r.txQueue.WakeWorkers()
+		}
+		return err
+	}
+
+	if err := advance(r.db); err != nil || !fired {
+		return err
+	}
+	if err := r.queue.AddJob(row.JobName, row.Payload); err != nil {
+		restoreErr := r.db.Model(&recurringJob{}).
+			Where("id = ? AND version = ?", row.ID, row.Version+1).
+			Updates(map[string]interface{}{
+				"next_run_at": row.NextRunAt,
+				"last_run_at": row.LastRunAt,
+				"version":     gorm.Expr("version + 1"),
+			}).Error
+		if restoreErr != nil {
+			logrus.Errorf("[recurring] restore job %s - %d: %s", row.JobName, row.ID, restoreErr)
+		}
+		return fmt.Errorf("enqueue job %s - %d: %w", row.JobName, row.ID, err)
+	}
+	return nil
+}
+
+func (r *recurringJob) descriptor() RecurringJob {
+	return RecurringJob{
+		ID:        formatJobID(r.ID),
+		CronSpec:  r.CronSpec,
+		JobName:   r.JobName,
+		Payload:   r.Payload,
+		Enabled:   r.Enabled,
+		Timezone:  r.Timezone,
+		NextRunAt: r.NextRunAt,
+		LastRunAt: r.LastRunAt,
+	}
+}
@@ -0,0 +1,203 @@
+package gocommonweb
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// enqueuedJobs Queue recording added jobs, the next failures adds fail
+type enqueuedJobs struct {
+	Queue
+	mutex    sync.Mutex
+	jobs     []string
+	failures int
+}
+
+func (q *enqueuedJobs) AddJob(jobName string, payload string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.failures > 0 {
+		q.failures--
+		return errors.New("queue unavailable")
+	}
+	q.jobs = append(q.jobs, jobName+":"+payload)
+	return nil
+}
+
+func (q *enqueuedJobs) list() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]string(nil), q.jobs...)
+}
+
+func TestRecurringJobsDB(t *testing.T) {
+	db := openTestDB(t)
+	queue := &enqueuedJobs{}
+	r, err := NewRecurringJobsDB(db, queue)
+	require.NoError(t, err)
+	registry := r.(*recurringJobsDB)
+
+	_, err = registry.Add(RecurringJob{CronSpec: "not a spec", JobName: "report"})
+	require.Error(t, err)
+	_, err = registry.Add(RecurringJob{CronSpec: "0 9 * * *", JobName: "report", Timezone: "Mars/Olympus"})
+	require.Error(t, err)
+
+	id, err := registry.Add(RecurringJob{
+		CronSpec: "0 9 * * *",
+		JobName:  "daily_report",
+		Payload:  "sales",
+		Enabled:  true,
+		Timezone: "Asia/Jakarta",
+	})
+	require.NoError(t, err)
+	job, err := registry.Get(id)
+	require.NoError(t, err)
+	require.NotNil(t, job.NextRunAt)
+	require.Equal(t, 2, job.NextRunAt.UTC().Hour(), "9 AM in Jakarta is 2 AM UTC")
+
+	disabledID, err := registry.Add(RecurringJob{CronSpec: "@every 1m", JobName: "cleanup"})
+	require.NoError(t, err)
+	disabled, err := registry.Get(disabledID)
+	require.NoError(t, err)
+	require.Nil(t, disabled.NextRunAt)
+
+	// two instances firing the same due job only enqueue it once
+	other, err := NewRecurringJobsDBWithOptions(db, queue, RecurringJobsDBOptions{PollInterval: time.Millisecond * 50})
+	require.NoError(t, err)
+	fireAt := job.NextRunAt.Add(time.Hour * 24 * 3)
+	errs := make(chan error, 2)
+	for _, instance := range []*recurringJobsDB{registry, other.(*recurringJobsDB)} {
+		go func(instance *recurringJobsDB) {
+			_, err := instance.fireDueJobs(fireAt)
+			errs <- err
+		}(instance)
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.Equal(t, []string{"daily_report:sales"}, queue.list())
+	job, err = registry.Get(id)
+	require.NoError(t, err)
+	require.True(t, job.NextRunAt.After(fireAt))
+	require.Equal(t, fireAt.Unix(), job.LastRunAt.Unix())
+
+	// changes are picked up by running instances without restart
+	other.Start()
+	defer other.Stop()
+	job.CronSpec = "@every 1s"
+	job.Payload = "hourly sales"
+	require.NoError(t, registry.Update(*job))
+	require.NoError(t, registry.SetEnabled(id, false))
+	disabled.CronSpec = "@every 1s"
+	disabled.Enabled = true
+	require.NoError(t, registry.Update(*disabled))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(queue.list()) < 2 {
+		require.True(t, time.Now().Before(deadline), "recurring job not fired")
+		time.Sleep(time.Millisecond * 20)
+	}
+	require.Equal(t, "cleanup:", queue.list()[1])
+	require.NotContains(t, queue.list(), "daily_report:hourly sales")
+
+	require.NoError(t, registry.Remove(disabledID))
+	require.Equal(t, ErrRecurringJobNotFound, registry.Remove(disabledID))
+	jobs, err := registry.List()
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	require.Equal(t, "hourly sales", jobs[0].Payload)
+	require.False(t, jobs[0].Enabled)
+}
+
+func TestRecurringJobsDBTimezone(t *testing.T) {
+	db := openTestDB(t)
+	queue := &enqueuedJobs{}
+	r, err := NewRecurringJobsDB(db, queue)
+	require.NoError(t, err)
+	registry := r.(*recurringJobsDB)
+	clock := time.Date(2021, 3, 13, 12, 0, 0, 0, time.UTC)
+	registry.clock = func() time.Time { return clock }
+
+	id, err := registry.Add(RecurringJob{CronSpec: "30 2 * * *", JobName: "backup", Enabled: true, Timezone: "America/New_York"})
+	require.NoError(t, err)
+	job, err := registry.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 3, 14, 7, 0, 0, 0, time.UTC), job.NextRunAt.UTC(), "skipped 02:30 runs at 03:00 EDT")
+
+	clock = job.NextRunAt.Add(time.Second)
+	next, err := registry.fireDueJobs(clock)
+	require.NoError(t, err)
+	require.Equal(t, []string{"backup:"}, queue.list())
+	require.Equal(t, time.Date(2021, 3, 15, 6, 30, 0, 0, time.UTC), next.UTC())
+
+	// CRON_TZ of the spec takes precedence over timezone of the job
+	job.CronSpec = "CRON_TZ=Asia/Jakarta */30 9 * * *"
+	require.NoError(t, registry.Update(*job))
+	job, err = registry.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 3, 15, 2, 0, 0, 0, time.UTC), job.NextRunAt.UTC())
+}
+
+func TestRecurringJobsDBEnqueueError(t *testing.T) {
+	db := openTestDB(t)
+	queue := &enqueuedJobs{failures: 1}
+	r, err := NewRecurringJobsDB(db, queue)
+	require.NoError(t, err)
+	registry := r.(*recurringJobsDB)
+
+	id, err := registry.Add(RecurringJob{CronSpec: "0 9 * * *", JobName: "daily_report", Enabled: true})
+	require.NoError(t, err)
+	job, err := registry.Get(id)
+	require.NoError(t, err)
+	_, err = registry.Add(RecurringJob{CronSpec: "5 9 * * *", JobName: "cleanup", Enabled: true})
+	require.NoError(t, err)
+
+	// firing is not lost when enqueue fails, the next pass retries it
+	// and other due jobs still fire in the same pass
+	fireAt := job.NextRunAt.Add(time.Minute * 10)
+	_, err = registry.fireDueJobs(fireAt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cleanup:"}, queue.list())
+	retried, err := registry.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, job.NextRunAt.Unix(), retried.NextRunAt.Unix())
+	require.Nil(t, retried.LastRunAt)
+
+	_, err = registry.fireDueJobs(fireAt)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cleanup:", "daily_report:"}, queue.list())
+}
+
+func TestRecurringJobsDBTransactionalQueue(t *testing.T) {
+	db := openTestDB(t)
+	queue, err := NewQueueDB(db, 1)
+	require.NoError(t, err)
+	r, err := NewRecurringJobsDB(db, queue)
+	require.NoError(t, err)
+	registry := r.(*recurringJobsDB)
+	require.NotNil(t, registry.txQueue)
+
+	other, err := NewQueueDB(openTestDB(t), 1)
+	require.NoError(t, err)
+	r, err = NewRecurringJobsDB(db, other)
+	require.NoError(t, err)
+	require.Nil(t, r.(*recurringJobsDB).txQueue, "queue in another database")
+
+	id, err := registry.Add(RecurringJob{CronSpec: "0 9 * * *", JobName: "daily_report", Payload: "sales", Enabled: true})
+	require.NoError(t, err)
+	recurring, err := registry.Get(id)
+	require.NoError(t, err)
+
+	// firing and enqueue are committed together
+	_, err = registry.fireDueJobs(recurring.NextRunAt.Add(time.Minute))
+	require.NoError(t, err)
+	var payloads []string
+	require.NoError(t, db.Model(&job{}).Where("job_name = ?", "daily_report").Pluck("payload", &payloads).Error)
+	require.Equal(t, []string{"sales"}, payloads)
+	fired, err := registry.Get(id)
+	require.NoError(t, err)
+	require.True(t, fired.NextRunAt.After(*recurring.NextRunAt))
+}
@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "Webhook-Signature"
+	HeaderEvent     = "Webhook-Event"
+	HeaderDelivery  = "Webhook-Delivery"
+)
+
+// Sign create signature header value in form of "t=<unix time>,v1=<hex hmac>"
+// where the hmac-sha256 is computed over "<unix time>.<payload>"
+func Sign(secret string, timestamp time.Time, payload string) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, computeHMAC(secret, ts, payload))
+}
+
+// VerifySignature check signature header sent along with payload, used by receiver.
+// tolerance limit how old the signature timestamp can be, zero to disable the check
+func VerifySignature(secret string, header string, payload string, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+
+	if ts == "" || sig == "" {
+		return fmt.Errorf("malformed webhook signature header")
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature timestamp: %s", err)
+	}
+
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return fmt.Errorf("webhook signature timestamp too old")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(computeHMAC(secret, ts, payload))) {
+		return fmt.Errorf("webhook signature mismatch")
+	}
+	return nil
+}
+
+func computeHMAC(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
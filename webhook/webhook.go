@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRetrying  = "retrying"
+	StatusSucceeded = "succeeded"
+	StatusDead      = "dead"
+)
+
+// Endpoint customer callback url registered for a tenant and event type
+type Endpoint struct {
+	gorm.Model
+	TenantID  string `gorm:"index"`
+	EventType string `gorm:"index"`
+	URL       string
+	Secret    string
+	Active    bool
+}
+
+// Delivery a single event sent to a single endpoint,
+// it can take several attempts until it succeeded or dead
+type Delivery struct {
+	gorm.Model
+	EndpointID    uint `gorm:"index"`
+	EventType     string
+	Payload       string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+// DeliveryAttempt record of one http call made for a delivery
+type DeliveryAttempt struct {
+	gorm.Model
+	DeliveryID uint `gorm:"index"`
+	Attempt    int
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+}
+
+// Config webhook delivery configuration, zero value fields
+// are replaced with their defaults
+type Config struct {
+	// JobName used to enqueue delivery job to the queue
+	JobName string
+
+	// MaxAttempts before delivery moved to dead state
+	MaxAttempts int
+
+	// BaseDelay first retry delay, doubled on every next attempt up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	HTTPClient *http.Client
+}
+
+// Webhooks register customer endpoints and deliver signed http callbacks
+// to them asynchronously through a queue
+type Webhooks interface {
+	// RegisterEndpoint add new endpoint with a generated signing secret
+	RegisterEndpoint(tenantID string, eventType string, url string) (*Endpoint, error)
+	RemoveEndpoint(endpointID uint) error
+	Endpoints(tenantID string) ([]Endpoint, error)
+
+	// Dispatch create delivery for every active endpoint of the tenant
+	// subscribed to eventType and enqueue them
+	Dispatch(tenantID string, eventType string, payload string) error
+
+	// Redeliver put dead delivery back to be retried from the first attempt
+	Redeliver(deliveryID uint) error
+	Deliveries(endpointID uint, status string) ([]Delivery, error)
+	Attempts(deliveryID uint) ([]DeliveryAttempt, error)
+}
+
+const (
+	defaultJobName     = "webhook_delivery"
+	defaultMaxAttempts = 8
+	defaultBaseDelay   = time.Second * 30
+	defaultMaxDelay    = time.Hour * 6
+	defaultHTTPTimeout = time.Second * 15
+)
+
+func (c Config) withDefaults() Config {
+	if c.JobName == "" {
+		c.JobName = defaultJobName
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = defaultBaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultMaxDelay
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	return c
+}
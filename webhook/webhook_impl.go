@@ -0,0 +1,257 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abdularis/gocommonweb"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type webhooksImpl struct {
+	db     *gorm.DB
+	queue  gocommonweb.Queue
+	config Config
+}
+
+// NewWebhooks create webhooks stored in db and delivered through queue,
+// it registers delivery job handler to the queue so the queue
+// should be started by the caller
+func NewWebhooks(db *gorm.DB, queue gocommonweb.Queue, config Config) (Webhooks, error) {
+	err := db.AutoMigrate(&Endpoint{}, &Delivery{}, &DeliveryAttempt{})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &webhooksImpl{
+		db:     db,
+		queue:  queue,
+		config: config.withDefaults(),
+	}
+	queue.AddJobHandler(w.config.JobName, w)
+	return w, nil
+}
+
+func (w *webhooksImpl) RegisterEndpoint(tenantID string, eventType string, url string) (*Endpoint, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := Endpoint{
+		TenantID:  tenantID,
+		EventType: eventType,
+		URL:       url,
+		Secret:    secret,
+		Active:    true,
+	}
+	if err := w.db.Create(&endpoint).Error; err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+func (w *webhooksImpl) RemoveEndpoint(endpointID uint) error {
+	return w.db.Delete(&Endpoint{}, endpointID).Error
+}
+
+func (w *webhooksImpl) Endpoints(tenantID string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	err := w.db.Where("tenant_id = ?", tenantID).Find(&endpoints).Error
+	return endpoints, err
+}
+
+func (w *webhooksImpl) Dispatch(tenantID string, eventType string, payload string) error {
+	var endpoints []Endpoint
+	err := w.db.
+		Where("tenant_id = ? AND event_type = ? AND active = ?", tenantID, eventType, true).
+		Find(&endpoints).Error
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		delivery := Delivery{
+			EndpointID:    endpoint.ID,
+			EventType:     eventType,
+			Payload:       payload,
+			Status:        StatusPending,
+			NextAttemptAt: time.Now(),
+		}
+		if err := w.db.Create(&delivery).Error; err != nil {
+			return err
+		}
+		// delivery that never got queued must not stay pending forever
+		if err := w.queue.AddJob(w.config.JobName, formatID(delivery.ID)); err != nil {
+			if delErr := w.db.Delete(&delivery).Error; delErr != nil {
+				logrus.Errorf("[webhook] err deleting unqueued delivery %d: %s", delivery.ID, delErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webhooksImpl) Redeliver(deliveryID uint) error {
+	res := w.db.Model(&Delivery{}).
+		Where("id = ? AND status = ?", deliveryID, StatusDead).
+		Updates(map[string]interface{}{
+			"status":          StatusPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("dead delivery %d not found", deliveryID)
+	}
+	return w.queue.AddJob(w.config.JobName, formatID(deliveryID))
+}
+
+func (w *webhooksImpl) Deliveries(endpointID uint, status string) ([]Delivery, error) {
+	var deliveries []Delivery
+	tx := w.db.Where("endpoint_id = ?", endpointID)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	err := tx.Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (w *webhooksImpl) Attempts(deliveryID uint) ([]DeliveryAttempt, error) {
+	var attempts []DeliveryAttempt
+	err := w.db.Where("delivery_id = ?", deliveryID).Order("attempt").Find(&attempts).Error
+	return attempts, err
+}
+
+// Handle run one delivery attempt, retry is scheduled here as a delayed job
+// instead of relying on the queue retry mechanism so the backoff and dead state
+// are the same whatever queue implementation is used
+func (w *webhooksImpl) Handle(_ string, payload string) error {
+	deliveryID, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil {
+		logrus.Errorf("[webhook] invalid delivery job payload: %s", payload)
+		return nil
+	}
+
+	var delivery Delivery
+	if err := w.db.First(&delivery, deliveryID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if delivery.Status == StatusSucceeded || delivery.Status == StatusDead {
+		return nil
+	}
+
+	var endpoint Endpoint
+	if err := w.db.First(&endpoint, delivery.EndpointID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return w.db.Model(&delivery).Update("status", StatusDead).Error
+		}
+		return err
+	}
+	if !endpoint.Active {
+		return w.db.Model(&delivery).Update("status", StatusDead).Error
+	}
+
+	delivery.Attempts++
+	attempt := w.send(&endpoint, &delivery)
+	if err := w.db.Create(&attempt).Error; err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"attempts": delivery.Attempts}
+	var delay time.Duration
+	if attempt.Error == "" {
+		updates["status"] = StatusSucceeded
+	} else if delivery.Attempts >= w.config.MaxAttempts {
+		updates["status"] = StatusDead
+		logrus.Debugf("[webhook] delivery %d dead after %d attempts", delivery.ID, delivery.Attempts)
+	} else {
+		delay = w.retryDelay(delivery.Attempts)
+		updates["status"] = StatusRetrying
+		updates["next_attempt_at"] = time.Now().Add(delay)
+	}
+	if err := w.db.Model(&delivery).Updates(updates).Error; err != nil {
+		return err
+	}
+	if updates["status"] != StatusRetrying {
+		return nil
+	}
+
+	// retry is scheduled only once its state is stored, when that fails the
+	// queue runs the job again so the delivery is not left retrying forever
+	delaySecs := uint((delay + time.Second - 1) / time.Second)
+	if err := w.queue.AddDelayedJob(w.config.JobName, payload, delaySecs); err != nil {
+		return fmt.Errorf("schedule retry of delivery %d: %w", delivery.ID, err)
+	}
+	return nil
+}
+
+func (w *webhooksImpl) send(endpoint *Endpoint, delivery *Delivery) DeliveryAttempt {
+	attempt := DeliveryAttempt{
+		DeliveryID: delivery.ID,
+		Attempt:    delivery.Attempts,
+	}
+
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, formatID(delivery.ID))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, start, delivery.Payload))
+
+	res, err := w.config.HTTPClient.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	attempt.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		attempt.Error = fmt.Sprintf("unexpected response status %d", res.StatusCode)
+	}
+	return attempt
+}
+
+// retryDelay exponential backoff, BaseDelay doubled on every attempt
+func (w *webhooksImpl) retryDelay(attempts int) time.Duration {
+	delay := w.config.BaseDelay
+	for i := 1; i < attempts && delay < w.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.config.MaxDelay {
+		delay = w.config.MaxDelay
+	}
+	return delay
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func formatID(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
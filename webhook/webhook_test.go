@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abdularis/gocommonweb"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// inlineQueue run job handler right away, delayed job is recorded
+// and only run when the test asks for it
+type inlineQueue struct {
+	gocommonweb.Queue
+	handlers map[string]gocommonweb.JobHandler
+	delayed  []string
+	addErr   error
+	delayErr error
+}
+
+func (q *inlineQueue) AddJobHandler(jobName string, handler gocommonweb.JobHandler) {
+	q.handlers[jobName] = handler
+}
+
+func (q *inlineQueue) AddJob(jobName string, payload string) error {
+	if q.addErr != nil {
+		return q.addErr
+	}
+	return q.handlers[jobName].Handle(jobName, payload)
+}
+
+func (q *inlineQueue) AddDelayedJob(jobName string, payload string, delaySecs uint) error {
+	if q.delayErr != nil {
+		return q.delayErr
+	}
+	q.delayed = append(q.delayed, payload)
+	return nil
+}
+
+func (q *inlineQueue) runDelayed(t *testing.T) {
+	delayed := q.delayed
+	q.delayed = nil
+	for _, payload := range delayed {
+		require.NoError(t, q.AddJob(defaultJobName, payload))
+	}
+}
+
+func newTestWebhooks(t *testing.T, config Config) (Webhooks, *inlineQueue) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	queue := &inlineQueue{handlers: make(map[string]gocommonweb.JobHandler)}
+	hooks, err := NewWebhooks(db, queue, config)
+	require.NoError(t, err)
+	return hooks, queue
+}
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   string
+	}
+	received := make(chan request, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- request{header: r.Header, body: string(body)}
+	}))
+	defer server.Close()
+
+	hooks, _ := newTestWebhooks(t, Config{})
+	endpoint, err := hooks.RegisterEndpoint("tenant-1", "invoice.paid", server.URL)
+	require.NoError(t, err)
+
+	_, err = hooks.RegisterEndpoint("tenant-2", "invoice.paid", server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, hooks.Dispatch("tenant-1", "invoice.paid", `{"id":1}`))
+	require.Len(t, received, 1)
+	req := <-received
+	require.Equal(t, `{"id":1}`, req.body)
+	require.Equal(t, "invoice.paid", req.header.Get(HeaderEvent))
+	require.NoError(t, VerifySignature(endpoint.Secret, req.header.Get(HeaderSignature), req.body, time.Minute))
+
+	deliveries, err := hooks.Deliveries(endpoint.ID, StatusSucceeded)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	attempts, err := hooks.Attempts(deliveries[0].ID)
+	require.NoError(t, err)
+	require.Len(t, attempts, 1)
+	require.Equal(t, http.StatusOK, attempts[0].StatusCode)
+}
+
+func TestWebhookRetryUntilDead(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	hooks, queue := newTestWebhooks(t, Config{MaxAttempts: 3})
+	endpoint, err := hooks.RegisterEndpoint("tenant-1", "invoice.paid", server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, hooks.Dispatch("tenant-1", "invoice.paid", `{}`))
+	queue.runDelayed(t)
+	queue.runDelayed(t)
+	require.Empty(t, queue.delayed)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	deliveries, err := hooks.Deliveries(endpoint.ID, StatusDead)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+
+	attempts, err := hooks.Attempts(deliveries[0].ID)
+	require.NoError(t, err)
+	require.Len(t, attempts, 3)
+	for i, attempt := range attempts {
+		require.Equal(t, i+1, attempt.Attempt)
+		require.Equal(t, http.StatusInternalServerError, attempt.StatusCode)
+	}
+
+	require.NoError(t, hooks.Redeliver(deliveries[0].ID))
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookRetryEnqueueError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	hooks, queue := newTestWebhooks(t, Config{MaxAttempts: 3})
+	endpoint, err := hooks.RegisterEndpoint("tenant-1", "invoice.paid", server.URL)
+	require.NoError(t, err)
+	require.NoError(t, hooks.Dispatch("tenant-1", "invoice.paid", `{}`))
+	require.Len(t, queue.delayed, 1)
+
+	// job fails so the queue runs it again instead of the retry getting lost
+	queue.delayErr = errors.New("queue down")
+	payload := queue.delayed[0]
+	queue.delayed = nil
+	err = queue.AddJob(defaultJobName, payload)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, queue.delayErr))
+
+	deliveries, err := hooks.Deliveries(endpoint.ID, StatusRetrying)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, 2, deliveries[0].Attempts)
+}
+
+func TestWebhookDispatchEnqueueError(t *testing.T) {
+	hooks, queue := newTestWebhooks(t, Config{})
+	endpoint, err := hooks.RegisterEndpoint("tenant-1", "invoice.paid", "http://127.0.0.1:0")
+	require.NoError(t, err)
+
+	queue.addErr = errors.New("queue down")
+	require.Equal(t, queue.addErr, hooks.Dispatch("tenant-1", "invoice.paid", `{}`))
+
+	deliveries, err := hooks.Deliveries(endpoint.ID, "")
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+}
+
+func TestVerifySignature(t *testing.T) {
+	header := Sign("secret", time.Now(), "payload")
+	require.NoError(t, VerifySignature("secret", header, "payload", time.Minute))
+	require.Error(t, VerifySignature("other", header, "payload", time.Minute))
+	require.Error(t, VerifySignature("secret", header, "tampered", time.Minute))
+
+	old := Sign("secret", time.Now().Add(-time.Hour), "payload")
+	require.Error(t, VerifySignature("secret", old, "payload", time.Minute))
+	require.NoError(t, VerifySignature("secret", old, "payload", 0))
+}
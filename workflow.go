@@ -0,0 +1,322 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WorkflowChain = "chain"
+	WorkflowBatch = "batch"
+
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	WorkflowFailed    = "failed"
+
+	// workflowPayloadPrefix marks payload of jobs enqueued by a workflow,
+	// jobs with plain payload are passed to the handler untouched
+	workflowPayloadPrefix = "gocommonweb.workflow:"
+)
+
+// WorkflowJob job to be enqueued as part of a workflow
+type WorkflowJob struct {
+	Name    string `json:"name"`
+	Payload string `json:"payload"`
+}
+
+// Batch jobs running in parallel, callbacks are enqueued as a chain.
+// OnFailure runs on the first failed job, OnSuccess when all jobs
+// succeeded and OnComplete when all jobs finished either way
+type Batch struct {
+	Jobs       []WorkflowJob
+	OnSuccess  []WorkflowJob
+	OnFailure  []WorkflowJob
+	OnComplete []WorkflowJob
+}
+
+// WorkflowProgress state of a chain or batch
+type WorkflowProgress struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Workflows run jobs of a Queue as chains and batches, handlers and job
+// options of jobs used in workflows must be registered through Workflows
+// so it knows when a job finished
+type Workflows interface {
+	AddJobHandler(jobName string, handler JobHandler)
+	AddJobContextHandler(jobName string, handler JobContextHandler)
+	SetJobOptions(jobName string, options JobOptions)
+
+	// Chain run jobs one after another, next job only runs
+	// after the previous one succeeded
+	Chain(jobs ...WorkflowJob) (string, error)
+	Batch(batch Batch) (string, error)
+	Progress(id string) (*WorkflowProgress, error)
+}
+
+// workflowState persisted state of a workflow
+type workflowState struct {
+	WorkflowProgress
+	Jobs       []WorkflowJob
+	OnSuccess  []WorkflowJob
+	OnFailure  []WorkflowJob
+	OnComplete []WorkflowJob
+}
+
+func (w *workflowState) finished() bool {
+	if w.Type == WorkflowChain {
+		return w.Failed > 0 || w.Completed >= w.Total
+	}
+	return w.Completed+w.Failed >= w.Total
+}
+
+func (w *workflowState) status() string {
+	if !w.finished() {
+		return WorkflowRunning
+	}
+	if w.Failed > 0 {
+		return WorkflowFailed
+	}
+	return WorkflowSucceeded
+}
+
+type workflowStore interface {
+	createWorkflow(state *workflowState) error
+	getWorkflow(id string) (*workflowState, error)
+
+	// jobFinished atomically record finished step of the workflow, the recorded
+	// step is returned until its follow-up is done and nil afterwards. a step
+	// finishing again keeps its first recorded outcome
+	jobFinished(id string, step int, failed bool) (*finishedStep, error)
+
+	// stepFollowedUp mark follow-up of a finished step done
+	stepFollowedUp(id string, step int) error
+}
+
+// finishedStep step recorded by workflowStore, counts of state
+// are as of when the step was recorded
+type finishedStep struct {
+	state  *workflowState
+	failed bool
+}
+
+type workflowEnvelope struct {
+	WorkflowID string `json:"workflow_id"`
+	Step       int    `json:"step"`
+	Payload    string `json:"payload"`
+}
+
+type workflowsImpl struct {
+	queue        Queue
+	store        workflowStore
+	jobOptions   map[string]JobOptions
+	optionsMutex sync.Mutex
+}
+
+func newWorkflows(queue Queue, store workflowStore) Workflows {
+	return &workflowsImpl{
+		queue:      queue,
+		store:      store,
+		jobOptions: make(map[string]JobOptions),
+	}
+}
+
+func (w *workflowsImpl) AddJobHandler(jobName string, handler JobHandler) {
+	w.AddJobContextHandler(jobName, AdaptJobHandler(handler))
+}
+
+func (w *workflowsImpl) AddJobContextHandler(jobName string, handler JobContextHandler) {
+	w.queue.AddJobContextHandler(jobName, JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		return w.handleJob(ctx, handler, job)
+	}))
+	if notifier, ok := w.queue.(lostJobNotifier); ok {
+		notifier.onJobLost(jobName, w.handleLostJob)
+	}
+}
+
+func (w *workflowsImpl) SetJobOptions(jobName string, options JobOptions) {
+	w.optionsMutex.Lock()
+	w.jobOptions[jobName] = options
+	w.optionsMutex.Unlock()
+	w.queue.SetJobOptions(jobName, options)
+}
+
+func (w *workflowsImpl) Chain(jobs ...WorkflowJob) (string, error) {
+	if len(jobs) == 0 {
+		return "", fmt.Errorf("chain must have at least one job")
+	}
+
+	state := &workflowState{
+		WorkflowProgress: WorkflowProgress{Type: WorkflowChain, Total: len(jobs)},
+		Jobs:             jobs,
+	}
+	if err := w.store.createWorkflow(state); err != nil {
+		return "", err
+	}
+	if err := w.enqueueStep(state, 0); err != nil {
+		w.failSteps(state.ID, 0, 1)
+		return state.ID, err
+	}
+	return state.ID, nil
+}
+
+func (w *workflowsImpl) Batch(batch Batch) (string, error) {
+	if len(batch.Jobs) == 0 {
+		return "", fmt.Errorf("batch must have at least one job")
+	}
+
+	state := &workflowState{
+		WorkflowProgress: WorkflowProgress{Type: WorkflowBatch, Total: len(batch.Jobs)},
+		Jobs:             batch.Jobs,
+		OnSuccess:        batch.OnSuccess,
+		OnFailure:        batch.OnFailure,
+		OnComplete:       batch.OnComplete,
+	}
+	if err := w.store.createWorkflow(state); err != nil {
+		return "", err
+	}
+	for step := range batch.Jobs {
+		if err := w.enqueueStep(state, step); err != nil {
+			// jobs already enqueued can't be taken back, steps never enqueued
+			// are failed so the batch still finishes
+			w.failSteps(state.ID, step, len(batch.Jobs))
+			return state.ID, err
+		}
+	}
+	return state.ID, nil
+}
+
+// failSteps record steps from index from up to to exclusive as failed
+func (w *workflowsImpl) failSteps(id string, from int, to int) {
+	for step := from; step < to; step++ {
+		if err := w.jobFinished(workflowEnvelope{WorkflowID: id, Step: step}, true); err != nil {
+			logrus.Errorf("[workflow] fail step %d of workflow %s: %s", step, id, err)
+		}
+	}
+}
+
+func (w *workflowsImpl) Progress(id string) (*WorkflowProgress, error) {
+	state, err := w.store.getWorkflow(id)
+	if err != nil {
+		return nil, err
+	}
+	progress := state.WorkflowProgress
+	progress.Status = state.status()
+	return &progress, nil
+}
+
+func (w *workflowsImpl) enqueueStep(state *workflowState, step int) error {
+	j := state.Jobs[step]
+	envelope, err := json.Marshal(workflowEnvelope{WorkflowID: state.ID, Step: step, Payload: j.Payload})
+	if err != nil {
+		return err
+	}
+	return w.queue.AddJob(j.Name, workflowPayloadPrefix+string(envelope))
+}
+
+func (w *workflowsImpl) handleJob(ctx context.Context, handler JobContextHandler, job *Job) error {
+	if !strings.HasPrefix(job.Payload, workflowPayloadPrefix) {
+		return handler.HandleJob(ctx, job)
+	}
+
+	var envelope workflowEnvelope
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(job.Payload, workflowPayloadPrefix)), &envelope); err != nil {
+		return PermanentError(fmt.Errorf("invalid workflow job payload: %w", err))
+	}
+
+	workflowJob := *job
+	workflowJob.Payload = envelope.Payload
+	err := handler.HandleJob(ctx, &workflowJob)
+	job.SetResult(workflowJob.result)
+
+	// cancelled by queue shutdown, the job will run again
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return err
+	}
+
+	w.optionsMutex.Lock()
+	options := w.jobOptions[job.Name]
+	w.optionsMutex.Unlock()
+	if err != nil && options.Retry.shouldRetry(job.Attempt, err) {
+		return err
+	}
+
+	// job runs again until its step is recorded and followed up
+	if finishErr := w.jobFinished(envelope, err != nil); finishErr != nil {
+		return fmt.Errorf("update workflow %s: %w", envelope.WorkflowID, finishErr)
+	}
+	return err
+}
+
+// handleLostJob mark step failed when the queue gave the job up without running
+// its handler, e.g. its worker stopped sending heartbeat on the last attempt
+func (w *workflowsImpl) handleLostJob(job *Job, jobErr error) {
+	if !strings.HasPrefix(job.Payload, workflowPayloadPrefix) {
+		return
+	}
+	var envelope workflowEnvelope
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(job.Payload, workflowPayloadPrefix)), &envelope); err != nil {
+		return
+	}
+	if err := w.jobFinished(envelope, true); err != nil {
+		logrus.Errorf("[workflow] update workflow %s: %s", envelope.WorkflowID, err)
+	}
+}
+
+// jobFinished advance the workflow once per step, queues deliver jobs at least
+// once so a step may finish again after its first finish was recorded. follow-up
+// of a step that failed before it was marked done is run again on the next finish
+func (w *workflowsImpl) jobFinished(envelope workflowEnvelope, failed bool) error {
+	step, err := w.store.jobFinished(envelope.WorkflowID, envelope.Step, failed)
+	if err != nil || step == nil {
+		return err
+	}
+	if err := w.followUp(envelope.Step, step); err != nil {
+		return err
+	}
+	return w.store.stepFollowedUp(envelope.WorkflowID, envelope.Step)
+}
+
+// followUp enqueue next step of a chain or callbacks of a batch
+func (w *workflowsImpl) followUp(stepIndex int, step *finishedStep) error {
+	state := step.state
+	if state.Type == WorkflowChain {
+		if !step.failed && stepIndex+1 < len(state.Jobs) {
+			return w.enqueueStep(state, stepIndex+1)
+		}
+		return nil
+	}
+
+	var callbacks [][]WorkflowJob
+	if step.failed && state.Failed == 1 {
+		callbacks = append(callbacks, state.OnFailure)
+	}
+	if state.finished() {
+		if state.Failed == 0 {
+			callbacks = append(callbacks, state.OnSuccess)
+		}
+		callbacks = append(callbacks, state.OnComplete)
+	}
+	for _, jobs := range callbacks {
+		if len(jobs) == 0 {
+			continue
+		}
+		if _, err := w.Chain(jobs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package gocommonweb
+
+import (
+	"encoding/json"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type workflow struct {
+	gorm.Model
+	Type      string
+	Total     int
+	Completed int
+	Failed    int
+
+	// job lists are stored as json
+	Jobs       string
+	OnSuccess  string
+	OnFailure  string
+	OnComplete string
+}
+
+// workflowStep finished step of a workflow, a step is counted only once
+// even when its job is delivered again
+type workflowStep struct {
+	WorkflowID uint `gorm:"primaryKey;autoIncrement:false"`
+	Step       int  `gorm:"primaryKey;autoIncrement:false"`
+	Failed     bool
+
+	// Pending follow-up of the step is not done yet, counts of the
+	// workflow when the step was recorded are kept for it
+	Pending           bool
+	WorkflowCompleted int
+	WorkflowFailed    int
+}
+
+type workflowStoreDB struct {
+	db *gorm.DB
+}
+
+// NewWorkflowsDB create workflows persisting its state in database
+func NewWorkflowsDB(db *gorm.DB, queue Queue) (Workflows, error) {
+	if err := db.AutoMigrate(&workflow{}, &workflowStep{}); err != nil {
+		return nil, err
+	}
+	return newWorkflows(queue, &workflowStoreDB{db: db}), nil
+}
+
+func (s *workflowStoreDB) createWorkflow(state *workflowState) error {
+	w := workflow{Type: state.Type, Total: state.Total}
+	lists := []struct {
+		jobs []WorkflowJob
+		dst  *string
+	}{
+		{state.Jobs, &w.Jobs},
+		{state.OnSuccess, &w.OnSuccess},
+		{state.OnFailure, &w.OnFailure},
+		{state.OnComplete, &w.OnComplete},
+	}
+	for _, list := range lists {
+		data, err := json.Marshal(list.jobs)
+		if err != nil {
+			return err
+		}
+		*list.dst = string(data)
+	}
+
+	if err := s.db.Create(&w).Error; err != nil {
+		return err
+	}
+	state.ID = formatJobID(w.ID)
+	state.CreatedAt = w.CreatedAt
+	return nil
+}
+
+func (s *workflowStoreDB) getWorkflow(id string) (*workflowState, error) {
+	workflowID, err := parseJobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var w workflow
+	if err := s.db.First(&w, workflowID).Error; err != nil {
+		return nil, err
+	}
+	return w.state()
+}
+
+func (s *workflowStoreDB) jobFinished(id string, step int, failed bool) (*finishedStep, error) {
+	workflowID, err := parseJobID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	column := "completed"
+	if failed {
+		column = "failed"
+	}
+
+	var w workflow
+	var recorded workflowStep
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&w, workflowID).Error
+		if err != nil {
+			return err
+		}
+
+		// counts after this step, the workflow row is locked
+		recorded = workflowStep{
+			WorkflowID:        workflowID,
+			Step:              step,
+			Failed:            failed,
+			Pending:           true,
+			WorkflowCompleted: w.Completed,
+			WorkflowFailed:    w.Failed,
+		}
+		if failed {
+			recorded.WorkflowFailed++
+		} else {
+			recorded.WorkflowCompleted++
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&recorded)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return tx.Where("workflow_id = ? AND step = ?", workflowID, step).Take(&recorded).Error
+		}
+
+		return tx.Model(&workflow{}).
+			Where("id = ?", workflowID).
+			UpdateColumn(column, gorm.Expr(column+" + 1")).Error
+	})
+	if err != nil || !recorded.Pending {
+		return nil, err
+	}
+
+	state, err := w.state()
+	if err != nil {
+		return nil, err
+	}
+	state.Completed = recorded.WorkflowCompleted
+	state.Failed = recorded.WorkflowFailed
+	return &finishedStep{state: state, failed: recorded.Failed}, nil
+}
+
+func (s *workflowStoreDB) stepFollowedUp(id string, step int) error {
+	workflowID, err := parseJobID(id)
+	if err != nil {
+		return err
+	}
+	return s.db.Model(&workflowStep{}).
+		Where("workflow_id = ? AND step = ?", workflowID, step).
+		Update("pending", false).Error
+}
+
+func (w *workflow) state() (*workflowState, error) {
+	state := &workflowState{
+		WorkflowProgress: WorkflowProgress{
+			ID:        formatJobID(w.ID),
+			Type:      w.Type,
+			Total:     w.Total,
+			Completed: w.Completed,
+			Failed:    w.Failed,
+			CreatedAt: w.CreatedAt,
+		},
+	}
+	lists := []struct {
+		src string
+		dst *[]WorkflowJob
+	}{
+		{w.Jobs, &state.Jobs},
+		{w.OnSuccess, &state.OnSuccess},
+		{w.OnFailure, &state.OnFailure},
+		{w.OnComplete, &state.OnComplete},
+	}
+	for _, list := range lists {
+		if err := json.Unmarshal([]byte(list.src), list.dst); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
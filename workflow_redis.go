@@ -0,0 +1,166 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// workflowRedisTTL workflow state expires this long after its last update
+const workflowRedisTTL = time.Hour * 24 * 7
+
+type workflowStoreRedis struct {
+	rds    redis.UniversalClient
+	prefix string
+}
+
+// NewWorkflowsRedis create workflows persisting its state in redis, namespace
+// prefixes workflow keys the same way as QueueRedisOptions.Namespace so on
+// redis cluster wrap it in braces e.g. "{myapp}"
+func NewWorkflowsRedis(redisClient redis.UniversalClient, namespace string, queue Queue) Workflows {
+	return newWorkflows(queue, newWorkflowStoreRedis(redisClient, namespace))
+}
+
+func newWorkflowStoreRedis(redisClient redis.UniversalClient, namespace string) *workflowStoreRedis {
+	if namespace == "" {
+		namespace = defaultRedisNamespace
+	}
+	return &workflowStoreRedis{rds: redisClient, prefix: redisNamespacePrefix(namespace) + "workflow:"}
+}
+
+func (s *workflowStoreRedis) key(id string) string {
+	return s.prefix + id
+}
+
+func (s *workflowStoreRedis) createWorkflow(state *workflowState) error {
+	ctx := context.Background()
+	id, err := s.rds.Incr(ctx, s.prefix+"id").Result()
+	if err != nil {
+		return err
+	}
+	state.ID = strconv.FormatInt(id, 10)
+	state.CreatedAt = time.Now()
+
+	values := map[string]interface{}{
+		"type":       state.Type,
+		"total":      state.Total,
+		"completed":  0,
+		"failed":     0,
+		"created_at": state.CreatedAt.UnixNano(),
+	}
+	lists := map[string][]WorkflowJob{
+		"jobs":        state.Jobs,
+		"on_success":  state.OnSuccess,
+		"on_failure":  state.OnFailure,
+		"on_complete": state.OnComplete,
+	}
+	for field, jobs := range lists {
+		data, err := json.Marshal(jobs)
+		if err != nil {
+			return err
+		}
+		values[field] = string(data)
+	}
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.key(state.ID), values)
+		pipe.Expire(ctx, s.key(state.ID), workflowRedisTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *workflowStoreRedis) getWorkflow(id string) (*workflowState, error) {
+	values, err := s.rds.HGetAll(context.Background(), s.key(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return workflowStateFromHash(id, values)
+}
+
+// workflowStepScript record finished step and count it when it was not recorded yet,
+// outcome of the step and counts after it are kept in the pending hash until its
+// follow-up is done. it returns the pending entry of the step, nil when there is none
+//
+// KEYS[1] workflow hash, KEYS[2] finished steps set, KEYS[3] pending steps hash
+// ARGV[1] step, ARGV[2] counter field, ARGV[3] ttl seconds
+var workflowStepScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return redis.error_reply("workflow not found")
+end
+if redis.call("SADD", KEYS[2], ARGV[1]) == 1 then
+	redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+	local counts = redis.call("HMGET", KEYS[1], "completed", "failed")
+	redis.call("HSET", KEYS[3], ARGV[1], ARGV[2] .. " " .. counts[1] .. " " .. counts[2])
+end
+for _, key in ipairs(KEYS) do
+	redis.call("EXPIRE", key, ARGV[3])
+end
+return redis.call("HGET", KEYS[3], ARGV[1])
+`)
+
+func (s *workflowStoreRedis) jobFinished(id string, step int, failed bool) (*finishedStep, error) {
+	ctx := context.Background()
+	field := "completed"
+	if failed {
+		field = "failed"
+	}
+
+	keys := []string{s.key(id), s.key(id) + ":steps", s.key(id) + ":pending"}
+	pending, err := workflowStepScript.Run(ctx, s.rds, keys, step, field, int(workflowRedisTTL.Seconds())).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.rds.HGetAll(ctx, s.key(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	state, err := workflowStateFromHash(id, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// counts as of the step, later steps may have finished since
+	var recordedField string
+	if _, err := fmt.Sscan(pending, &recordedField, &state.Completed, &state.Failed); err != nil {
+		return nil, err
+	}
+	return &finishedStep{state: state, failed: recordedField == "failed"}, nil
+}
+
+func (s *workflowStoreRedis) stepFollowedUp(id string, step int) error {
+	return s.rds.HDel(context.Background(), s.key(id)+":pending", strconv.Itoa(step)).Err()
+}
+
+func workflowStateFromHash(id string, values map[string]string) (*workflowState, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("workflow %s not found", id)
+	}
+
+	state := &workflowState{WorkflowProgress: WorkflowProgress{ID: id, Type: values["type"]}}
+	state.Total, _ = strconv.Atoi(values["total"])
+	state.Completed, _ = strconv.Atoi(values["completed"])
+	state.Failed, _ = strconv.Atoi(values["failed"])
+	createdAt, _ := strconv.ParseInt(values["created_at"], 10, 64)
+	state.CreatedAt = time.Unix(0, createdAt)
+
+	lists := map[string]*[]WorkflowJob{
+		"jobs":        &state.Jobs,
+		"on_success":  &state.OnSuccess,
+		"on_failure":  &state.OnFailure,
+		"on_complete": &state.OnComplete,
+	}
+	for field, dst := range lists {
+		if err := json.Unmarshal([]byte(values[field]), dst); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,257 @@
+package gocommonweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkflowsDB(t *testing.T) {
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	workflows, err := NewWorkflowsDB(openTestDB(t), queue)
+	require.NoError(t, err)
+
+	var handled []string
+	handler := JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Name+":"+job.Payload)
+		if job.Payload == "broken.png" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	workflows.SetJobOptions("resize_image", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	for _, name := range []string{"resize_image", "build_zip", "email_link", "report_failure"} {
+		workflows.AddJobContextHandler(name, handler)
+	}
+
+	// plain jobs are not affected by workflows
+	require.NoError(t, queue.AddJob("email_link", "plain"))
+	require.Equal(t, []string{"email_link:plain"}, handled)
+
+	handled = nil
+	id, err := workflows.Batch(Batch{
+		Jobs:      []WorkflowJob{{Name: "resize_image", Payload: "1.png"}, {Name: "resize_image", Payload: "2.png"}},
+		OnSuccess: []WorkflowJob{{Name: "build_zip", Payload: "images.zip"}, {Name: "email_link", Payload: "aris"}},
+		OnFailure: []WorkflowJob{{Name: "report_failure"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"resize_image:1.png", "resize_image:2.png", "build_zip:images.zip", "email_link:aris",
+	}, handled)
+
+	progress, err := workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowSucceeded, progress.Status)
+	require.Equal(t, 2, progress.Completed)
+
+	handled = nil
+	id, err = workflows.Batch(Batch{
+		Jobs:      []WorkflowJob{{Name: "resize_image", Payload: "broken.png"}, {Name: "resize_image", Payload: "3.png"}},
+		OnSuccess: []WorkflowJob{{Name: "build_zip"}},
+		OnFailure: []WorkflowJob{{Name: "report_failure", Payload: "broken"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"resize_image:broken.png", "report_failure:broken", "resize_image:3.png"}, handled)
+
+	progress, err = workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowFailed, progress.Status)
+	require.Equal(t, 1, progress.Failed)
+
+	// chain stops at the failed job
+	handled = nil
+	id, err = workflows.Chain(
+		WorkflowJob{Name: "resize_image", Payload: "broken.png"},
+		WorkflowJob{Name: "build_zip"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"resize_image:broken.png"}, handled)
+
+	progress, err = workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowFailed, progress.Status)
+	require.Equal(t, 2, progress.Total)
+}
+
+func TestWorkflowsStepFinishedOnce(t *testing.T) {
+	db := openTestDB(t)
+	queue := NewQueueMemory(QueueMemoryOptions{Sync: true})
+	workflows, err := NewWorkflowsDB(db, queue)
+	require.NoError(t, err)
+
+	var handled []string
+	handler := JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Name+":"+job.Payload)
+		return nil
+	})
+	for _, name := range []string{"resize_image", "build_zip", "email_link"} {
+		workflows.AddJobContextHandler(name, handler)
+	}
+
+	id, err := workflows.Chain(
+		WorkflowJob{Name: "resize_image", Payload: "1.png"},
+		WorkflowJob{Name: "build_zip", Payload: "images.zip"},
+	)
+	require.NoError(t, err)
+	batchID, err := workflows.Batch(Batch{
+		Jobs:       []WorkflowJob{{Name: "resize_image", Payload: "2.png"}, {Name: "resize_image", Payload: "3.png"}},
+		OnComplete: []WorkflowJob{{Name: "email_link", Payload: "aris"}},
+	})
+	require.NoError(t, err)
+
+	// queue delivers steps again e.g. after a worker lost its lease
+	handled = nil
+	for _, envelope := range []workflowEnvelope{
+		{WorkflowID: id, Step: 0, Payload: "1.png"},
+		{WorkflowID: batchID, Step: 1, Payload: "3.png"},
+	} {
+		payload, err := json.Marshal(envelope)
+		require.NoError(t, err)
+		require.NoError(t, queue.AddJob("resize_image", workflowPayloadPrefix+string(payload)))
+	}
+	require.Equal(t, []string{"resize_image:1.png", "resize_image:3.png"}, handled)
+
+	for _, workflowID := range []string{id, batchID} {
+		progress, err := workflows.Progress(workflowID)
+		require.NoError(t, err)
+		require.Equal(t, WorkflowSucceeded, progress.Status)
+		require.Equal(t, 2, progress.Completed)
+	}
+}
+
+func TestWorkflowsLostJob(t *testing.T) {
+	db := openTestDB(t)
+	q, err := NewQueueDBWithOptions(db, QueueDBOptions{
+		Queues:            []WorkerQueue{{Name: DefaultQueueName, Workers: 1}},
+		VisibilityTimeout: time.Millisecond * 50,
+	})
+	require.NoError(t, err)
+	queue := q.(*queueDB)
+	workflows, err := NewWorkflowsDB(db, queue)
+	require.NoError(t, err)
+	workflows.SetJobOptions("resize_image", JobOptions{Retry: RetryPolicy{MaxAttempts: 1}})
+	workflows.AddJobHandler("resize_image", nil)
+	workflows.AddJobHandler("report_failure", nil)
+
+	id, err := workflows.Batch(Batch{
+		Jobs:      []WorkflowJob{{Name: "resize_image", Payload: "1.png"}},
+		OnFailure: []WorkflowJob{{Name: "report_failure"}},
+	})
+	require.NoError(t, err)
+
+	// worker claimed the step and crashed on its last attempt
+	_, err = queue.claimJobs(DefaultQueueName, 1)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	count, err := queue.requeueStaleJobs()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	progress, err := workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowFailed, progress.Status)
+	var callbacks int64
+	require.NoError(t, db.Model(&job{}).Where("job_name = ?", "report_failure").Count(&callbacks).Error)
+	require.Equal(t, int64(1), callbacks)
+}
+
+func TestWorkflowsRedisStepFinishedOnce(t *testing.T) {
+	rds := openTestRedis(t)
+	store := newWorkflowStoreRedis(rds, "{test}")
+	state := &workflowState{
+		WorkflowProgress: WorkflowProgress{Type: WorkflowBatch, Total: 2},
+		Jobs:             []WorkflowJob{{Name: "resize_image"}, {Name: "resize_image"}},
+	}
+	require.NoError(t, store.createWorkflow(state))
+
+	// keys are namespaced like queue keys so they share its cluster slot
+	exists, err := rds.Exists(context.Background(), "{test}:workflow:"+state.ID).Result()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), exists)
+
+	step, err := store.jobFinished(state.ID, 0, false)
+	require.NoError(t, err)
+	require.False(t, step.failed)
+	require.Equal(t, 1, step.state.Completed)
+
+	// step keeps its first outcome until its follow-up is done
+	step, err = store.jobFinished(state.ID, 0, true)
+	require.NoError(t, err)
+	require.False(t, step.failed)
+	require.Equal(t, 1, step.state.Completed)
+	require.Zero(t, step.state.Failed)
+	require.NoError(t, store.stepFollowedUp(state.ID, 0))
+	step, err = store.jobFinished(state.ID, 0, false)
+	require.NoError(t, err)
+	require.Nil(t, step)
+
+	step, err = store.jobFinished(state.ID, 1, true)
+	require.NoError(t, err)
+	require.True(t, step.failed)
+	require.Equal(t, 1, step.state.Failed)
+	require.True(t, step.state.finished())
+
+	_, err = store.jobFinished("404", 0, false)
+	require.Error(t, err)
+}
+
+// flakyQueue fail adding jobs of a job name the given number of times
+type flakyQueue struct {
+	Queue
+	jobName  string
+	failures int
+}
+
+func (q *flakyQueue) AddJob(jobName string, payload string) error {
+	if jobName == q.jobName && q.failures != 0 {
+		q.failures--
+		return errors.New("queue down")
+	}
+	return q.Queue.AddJob(jobName, payload)
+}
+
+func TestWorkflowsFollowUpError(t *testing.T) {
+	queue := &flakyQueue{Queue: NewQueueMemory(QueueMemoryOptions{Sync: true})}
+	workflows, err := NewWorkflowsDB(openTestDB(t), queue)
+	require.NoError(t, err)
+
+	var handled []string
+	handler := JobContextHandlerFunc(func(ctx context.Context, job *Job) error {
+		handled = append(handled, job.Name+":"+job.Payload)
+		return nil
+	})
+	for _, name := range []string{"resize_image", "build_zip", "report_failure"} {
+		workflows.AddJobContextHandler(name, handler)
+	}
+
+	// step runs again until the next step of the chain is enqueued
+	queue.jobName, queue.failures = "build_zip", 1
+	id, err := workflows.Chain(
+		WorkflowJob{Name: "resize_image", Payload: "1.png"},
+		WorkflowJob{Name: "build_zip", Payload: "images.zip"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"resize_image:1.png", "resize_image:1.png", "build_zip:images.zip"}, handled)
+	progress, err := workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowSucceeded, progress.Status)
+
+	// steps of a batch that could not be enqueued are failed
+	handled = nil
+	queue.jobName, queue.failures = "build_zip", -1
+	id, err = workflows.Batch(Batch{
+		Jobs:      []WorkflowJob{{Name: "resize_image", Payload: "2.png"}, {Name: "build_zip"}},
+		OnFailure: []WorkflowJob{{Name: "report_failure", Payload: "batch"}},
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{"resize_image:2.png", "report_failure:batch"}, handled)
+	progress, err = workflows.Progress(id)
+	require.NoError(t, err)
+	require.Equal(t, WorkflowFailed, progress.Status)
+	require.Equal(t, 1, progress.Completed)
+	require.Equal(t, 1, progress.Failed)
+}